@@ -1,6 +1,9 @@
 package gospider
 
-import "io/ioutil"
+import (
+	"context"
+	"sync"
+)
 
 /**************************************************************
 * interface: Analyzer
@@ -12,6 +15,12 @@ type Parser func(res *Response) ([]Data, error)
 // Parser map is a map holding parsers
 type ParserMap map[string]Parser
 
+// Errback is function which takes failed Request and yields replacement Requests/Items
+type Errback func(req *Request, err error) ([]Data, error)
+
+// ErrbackMap is a map holding errbacks
+type ErrbackMap map[string]Errback
+
 // Analyzer is interface for module Analyzer
 // Analyzer take Response as input and yield multiple Request or Item
 type Analyzer interface {
@@ -20,6 +29,82 @@ type Analyzer interface {
 	Analyze(res *Response) ([]Data, error)
 }
 
+// ErrbackAnalyzer is analyzer that could handle failed requests
+type ErrbackAnalyzer interface {
+	Analyzer
+	// HandleError will invoke errback according to req.Errback
+	// return ErrCallbackNotFount if no errback could be found
+	HandleError(req *Request, err error) ([]Data, error)
+}
+
+// ContextAnalyzer is analyzer that could be cancelled by context
+type ContextAnalyzer interface {
+	Analyzer
+	AnalyzeContext(ctx context.Context, res *Response) ([]Data, error)
+}
+
+// AnalyzeContext adapts any Analyzer to context-carrying version
+// parser could check res.Context() to abort early. anyway ctx.Err()
+// is returned as soon as ctx is done
+func AnalyzeContext(ctx context.Context, a Analyzer, res *Response) ([]Data, error) {
+	if ca, ok := a.(ContextAnalyzer); ok {
+		return ca.AnalyzeContext(ctx, res)
+	}
+	if res != nil {
+		res = res.WithContext(ctx)
+	}
+	return parseContext(ctx, a.Analyze, res)
+}
+
+// parseContext run parser in a new goroutine and wait until it finish or ctx done
+// data yield after ctx done is discarded, with bodies of responses in it closed
+func parseContext(ctx context.Context, parser Parser, res *Response) ([]Data, error) {
+	type result struct {
+		data []Data
+		err  error
+	}
+	// abandoned is set when ctx is done, worker never blocks on sending
+	var lock sync.Mutex
+	abandoned := false
+	discard := func(data []Data) {
+		for _, datum := range data {
+			if r, ok := datum.(*Response); ok {
+				closeResponse(r)
+			}
+		}
+	}
+	if res != nil {
+		// parser starts from beginning of body whatever read it before
+		res.rewind()
+	}
+	c := make(chan result, 1)
+	go func() {
+		data, err := parser(res)
+		lock.Lock()
+		defer lock.Unlock()
+		if abandoned {
+			discard(data)
+			return
+		}
+		c <- result{data, err}
+	}()
+
+	select {
+	case r := <-c:
+		return r.data, r.err
+	case <-ctx.Done():
+		lock.Lock()
+		abandoned = true
+		lock.Unlock()
+		select {
+		case r := <-c:
+			discard(r.data)
+		default:
+		}
+		return nil, ctx.Err()
+	}
+}
+
 /**************************************************************
 * struct: myAnalyzer
 **************************************************************/
@@ -27,12 +112,18 @@ type Analyzer interface {
 // myAnalyzer is default implementation of interface Analyzer
 type myAnalyzer struct {
 	parsers       ParserMap
+	errbacks      ErrbackMap
 	defaultParser Parser
 }
 
 // NewAnalyzer will init a new Analyzer will a parserMap
-// if parsers == nil, then BodyReader is used as default analyzer
-func NewAnalyzer(parsers ParserMap) (Analyzer, error) {
+// spider middlewares are applied in given order, see SpiderMiddleware
+func NewAnalyzer(parsers ParserMap, middlewares ...SpiderMiddleware) (Analyzer, error) {
+	return NewAnalyzerErrback(parsers, nil, middlewares...)
+}
+
+// NewAnalyzerErrback is like NewAnalyzer with errbacks for failed requests
+func NewAnalyzerErrback(parsers ParserMap, errbacks ErrbackMap, middlewares ...SpiderMiddleware) (Analyzer, error) {
 	// if map contains a parser named "default", then it is the default parser
 	var defaultParser Parser
 	// if no parser is provided, use content reader as default parser and new a ParserMap
@@ -53,21 +144,31 @@ func NewAnalyzer(parsers ParserMap) (Analyzer, error) {
 		}
 	}
 
-	return &myAnalyzer{
+	for _, m := range middlewares {
+		if m == nil {
+			return nil, ErrNilMiddleware
+		}
+	}
+
+	for _, e := range errbacks {
+		if e == nil {
+			return nil, ErrNilParser
+		}
+	}
+
+	return NewAnalyzerChain(&myAnalyzer{
 		parsers:       parsers,
+		errbacks:      errbacks,
 		defaultParser: defaultParser,
-	}, nil
+	}, middlewares...), nil
 }
 
 // NewAnalyzerSolo is one-parser only version of Analyzer constructor
-func NewAnalyzerSolo(parser Parser) (Analyzer, error) {
+func NewAnalyzerSolo(parser Parser, middlewares ...SpiderMiddleware) (Analyzer, error) {
 	if parser == nil {
 		return nil, ErrNilParser
 	}
-	return &myAnalyzer{
-		parsers:       ParserMap{KeyDefault: parser},
-		defaultParser: parser,
-	}, nil
+	return NewAnalyzer(ParserMap{KeyDefault: parser}, middlewares...)
 }
 
 // myAnalyzer_GetParser will get parser by name
@@ -78,8 +179,42 @@ func (self *myAnalyzer) GetParser(name string) Parser {
 	return nil
 }
 
+// myAnalyzer_GetErrback will get errback by name
+func (self *myAnalyzer) GetErrback(name string) Errback {
+	if e, ok := self.errbacks[name]; ok {
+		return e
+	}
+	return nil
+}
+
+// myAnalyzer_HandleError will invoke errback named req.Errback
+func (self *myAnalyzer) HandleError(req *Request, err error) ([]Data, error) {
+	if req == nil || req.Errback == "" {
+		return nil, ErrCallbackNotFount
+	}
+	errback := self.GetErrback(req.Errback)
+	if errback == nil {
+		return nil, ErrCallbackNotFount
+	}
+	return errback(req, err)
+}
+
 // myAnalyzer_Analyze will parse response and yield request & items
 func (self *myAnalyzer) Analyze(res *Response) ([]Data, error) {
+	return self.callback(res)(res)
+}
+
+// myAnalyzer_AnalyzeContext is like Analyze while ctx is attached to response
+func (self *myAnalyzer) AnalyzeContext(ctx context.Context, res *Response) ([]Data, error) {
+	if res == nil {
+		return nil, ErrNilResponse
+	}
+	res = res.WithContext(ctx)
+	return parseContext(ctx, self.callback(res), res)
+}
+
+// myAnalyzer_callback will find parser for given response
+func (self *myAnalyzer) callback(res *Response) Parser {
 	// use default parser by default
 	callback := self.defaultParser
 
@@ -90,18 +225,18 @@ func (self *myAnalyzer) Analyze(res *Response) ([]Data, error) {
 		}
 	}
 
-	return callback(res)
+	return callback
 }
 
 /**************************************************************
 * Parser: BodyReader
 **************************************************************/
-// BodyReader is a naive parser that read html body(string) into item["body"]
+// BodyReader is a naive parser that read html body(UTF-8 text) into item["body"]
 // and also copy all kv in request's meta to item (cautious: do not use "content" as key)
 // This can be used when no analyzer is given
 func BodyReader(res *Response) ([]Data, error) {
 	item := make(Item, len(res.Request.Meta)+1)
-	if body, err := ioutil.ReadAll(res.Response.Body); err != nil {
+	if body, err := res.Text(); err != nil {
 		return nil, err
 	} else {
 		// copy request meta to item
@@ -110,7 +245,7 @@ func BodyReader(res *Response) ([]Data, error) {
 		}
 
 		// copy body(string) to item["content"]. it will overwrite meta's content (if set)
-		item[KeyBody] = string(body)
+		item[KeyBody] = body
 		return item.DataList(), nil
 	}
 }
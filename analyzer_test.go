@@ -90,3 +90,37 @@ func TestNewAnalyzerWithCallback(t *testing.T) {
 		t.Error(`default Analyzer's string(content) is not equal original body`)
 	}
 }
+
+func TestAnalyzerErrback(t *testing.T) {
+	analyzer, err := NewAnalyzerErrback(
+		ParserMap{KeyDefault: BodyReader},
+		ErrbackMap{"fail": func(req *Request, err error) ([]Data, error) {
+			return Item{"url": req.URL.String(), "error": err.Error()}.DataList(), nil
+		}},
+		RefererMiddleware{},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ea, ok := analyzer.(ErrbackAnalyzer)
+	if !ok {
+		t.Fatal("default analyzer should handle errback")
+	}
+
+	req, _ := NewGetRequest("http://a.com")
+	if _, err := ea.HandleError(req, ErrDownloadFail); err != ErrCallbackNotFount {
+		t.Error("request without errback should not be handled")
+	}
+
+	data, err := ea.HandleError(req.SetErrback("fail"), ErrDownloadFail)
+	if err != nil || len(data) != 1 {
+		t.Fatal("errback should be invoked")
+	}
+	if item := data[0].(Item); item["url"] != "http://a.com" || item["error"] != ErrDownloadFail.Error() {
+		t.Error("errback should get failed request and error")
+	}
+	if req.Callback != "" {
+		t.Error("SetErrback should not touch callback")
+	}
+}
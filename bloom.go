@@ -0,0 +1,466 @@
+package gospider
+
+import (
+	"encoding/binary"
+	"errors"
+	"hash/fnv"
+	"io"
+	"io/ioutil"
+	"math"
+	mbits "math/bits"
+	"sync"
+	"github.com/go-redis/redis"
+)
+
+/**************************************************************
+* bloom: parameters & hashing
+**************************************************************/
+
+// Default capacity and false positive rate of bloom filters
+var (
+	DefaultBloomItems uint    = 10000000
+	DefaultBloomFPRate float64 = 0.001
+)
+
+var ErrInvalidBloom = errors.New("invalid bloom filter data")
+var ErrBloomKeyType = errors.New("redis key does not hold a bloom bitmap")
+
+// BloomSize returns bits number m and hash number k for n items with fp rate p
+func BloomSize(n uint, p float64) (m uint64, k uint) {
+	if n == 0 {
+		n = 1
+	}
+	if p <= 0 || p >= 1 {
+		p = DefaultBloomFPRate
+	}
+	m = uint64(math.Ceil(-float64(n) * math.Log(p) / (math.Ln2 * math.Ln2)))
+	k = uint(math.Round(float64(m) / float64(n) * math.Ln2))
+	if k < 1 {
+		k = 1
+	}
+	return
+}
+
+// bloomLocations returns k bit offsets of key using double hashing
+func bloomLocations(key string, m uint64, k uint) []uint64 {
+	h1 := fnv.New64a()
+	h1.Write([]byte(key))
+	h2 := fnv.New64()
+	h2.Write([]byte(key))
+	a, b := h1.Sum64(), h2.Sum64()|1
+
+	locs := make([]uint64, k)
+	for i := range locs {
+		locs[i] = (a + uint64(i)*b) % m
+	}
+	return locs
+}
+
+// bloomHeaderSize is size of serialized header: m & k as big endian uint64
+const bloomHeaderSize = 16
+
+/**************************************************************
+* struct: bloomFilter
+**************************************************************/
+
+// bloomFilter is in-memory bloom filter
+// bit i is stored in byte i/8 from high bit, same as redis bitmap
+type bloomFilter struct {
+	lock  sync.Mutex
+	m     uint64
+	k     uint
+	bits  []byte
+	count int
+	fp    *FingerprintOptions
+}
+
+// NewBloomFilter create a bloom filter for n items with false positive rate p
+func NewBloomFilter(n uint, p float64, opts ...*FingerprintOptions) Filter {
+	m, k := BloomSize(n, p)
+	return &bloomFilter{m: m, k: k, bits: make([]byte, (m+7)/8), fp: fingerprintOptions(opts)}
+}
+
+// bloomFilter_Seen : Caller must guarantee req is not nil
+func (self *bloomFilter) Seen(req *Request) bool {
+	return self.SeenURL(self.fp.Fingerprint(req))
+}
+
+// bloomFilter_SeenURL test and set raw key
+func (self *bloomFilter) SeenURL(key string) bool {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	seen := true
+	for _, loc := range bloomLocations(key, self.m, self.k) {
+		mask := byte(0x80) >> (loc % 8)
+		if self.bits[loc/8]&mask == 0 {
+			seen = false
+			self.bits[loc/8] |= mask
+		}
+	}
+	if !seen {
+		self.count++
+	}
+	return seen
+}
+
+// bloomFilter_contains test key without setting it
+func (self *bloomFilter) contains(key string) bool {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	for _, loc := range bloomLocations(key, self.m, self.k) {
+		if self.bits[loc/8]&(byte(0x80)>>(loc%8)) == 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// bloomFilter_MarshalBinary implements encoding.BinaryMarshaler
+func (self *bloomFilter) MarshalBinary() ([]byte, error) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	return marshalBloom(self.m, self.k, self.bits), nil
+}
+
+// bloomFilter_UnmarshalBinary implements encoding.BinaryUnmarshaler
+func (self *bloomFilter) UnmarshalBinary(data []byte) error {
+	m, k, bits, err := unmarshalBloom(data)
+	if err != nil {
+		return err
+	}
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	self.m, self.k, self.bits = m, k, bits
+	self.count = int(bloomEstimate(m, k, bits) + 0.5)
+	return nil
+}
+
+// bloomFilter_Len implements LenFilter. it is estimated after restored
+func (self *bloomFilter) Len() int {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	return self.count
+}
+
+// bloomFilter_Stats implements StatsFilter
+func (self *bloomFilter) Stats() FilterStats {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	return FilterStats{
+		Len:    self.count,
+		Bytes:  len(self.bits),
+		FPRate: math.Pow(float64(bloomOnes(self.bits))/float64(self.m), float64(self.k)),
+	}
+}
+
+// bloomFilter_Save write filter in MarshalBinary format
+func (self *bloomFilter) Save(w io.Writer) error {
+	data, _ := self.MarshalBinary()
+	_, err := w.Write(data)
+	return err
+}
+
+// bloomFilter_Load replace filter with data written by Save
+func (self *bloomFilter) Load(r io.Reader) error {
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	return self.UnmarshalBinary(data)
+}
+
+// bloomOnes count set bits
+func bloomOnes(bits []byte) (n uint64) {
+	for _, b := range bits {
+		n += uint64(mbits.OnesCount8(b))
+	}
+	return
+}
+
+// bloomEstimate estimate number of items with set bits: -m/k * ln(1 - ones/m)
+func bloomEstimate(m uint64, k uint, bits []byte) float64 {
+	ones := bloomOnes(bits)
+	if ones >= m {
+		return float64(m)
+	}
+	return -float64(m) / float64(k) * math.Log(1-float64(ones)/float64(m))
+}
+
+func marshalBloom(m uint64, k uint, bits []byte) []byte {
+	buf := make([]byte, bloomHeaderSize+len(bits))
+	binary.BigEndian.PutUint64(buf[0:8], m)
+	binary.BigEndian.PutUint64(buf[8:16], uint64(k))
+	copy(buf[bloomHeaderSize:], bits)
+	return buf
+}
+
+func unmarshalBloom(data []byte) (m uint64, k uint, bits []byte, err error) {
+	if len(data) < bloomHeaderSize {
+		return 0, 0, nil, ErrInvalidBloom
+	}
+	m = binary.BigEndian.Uint64(data[0:8])
+	k = uint(binary.BigEndian.Uint64(data[8:16]))
+	if m == 0 || k == 0 || uint64(len(data)-bloomHeaderSize) > (m+7)/8 {
+		return 0, 0, nil, ErrInvalidBloom
+	}
+	// trailing zero bytes may be omitted (e.g. by redis)
+	bits = make([]byte, (m+7)/8)
+	copy(bits, data[bloomHeaderSize:])
+	return
+}
+
+/**************************************************************
+* struct: redisBloomFilter
+**************************************************************/
+
+// redisBloomScript set k bits and returns how many of them were already set
+var redisBloomScript = redis.NewScript(`
+local seen = 0
+for i = 1, #ARGV do
+	seen = seen + redis.call('SETBIT', KEYS[1], ARGV[i], 1)
+end
+return seen
+`)
+
+// redisBloomSuffix is appended to key of redis bloom filter. former filter kept
+// a HyperLogLog at bare key, which is a redis string too and would be corrupted
+const redisBloomSuffix = ":bloom"
+
+// redisBloomFilter is bloom filter stored in redis bitmap using SETBIT/GETBIT
+type redisBloomFilter struct {
+	key    string
+	client *redis.Client
+	m      uint64
+	k      uint
+	fp     *FingerprintOptions
+}
+
+// NewRedisBloomFilter create a redis bloom filter with default capacity and fp rate
+func NewRedisBloomFilter(redisURL string, key string, opts ...*FingerprintOptions) (Filter, error) {
+	return NewRedisBloomFilterSize(redisURL, key, DefaultBloomItems, DefaultBloomFPRate, opts...)
+}
+
+// NewRedisBloomFilterSize create a redis bloom filter for n items with false positive rate p
+// same n & p must be used for same key, otherwise filter state is meaningless
+// bitmap is stored at key + ":bloom", ErrBloomKeyType is returned if it holds other data
+//
+// migration: HyperLogLog left at bare key by former filter can not be converted
+// and is never touched, delete it once the new filter has taken over
+func NewRedisBloomFilterSize(redisURL string, key string, n uint, p float64, opts ...*FingerprintOptions) (Filter, error) {
+	client, err := newRedisClient(redisURL)
+	if err != nil {
+		return nil, err
+	}
+	key += redisBloomSuffix
+	if err = checkBloomKey(client, key); err != nil {
+		client.Close()
+		return nil, err
+	}
+	m, k := BloomSize(n, p)
+	return &redisBloomFilter{key: key, client: client, m: m, k: k, fp: fingerprintOptions(opts)}, nil
+}
+
+// checkBloomKey makes sure key is empty or a plain bitmap, not a HyperLogLog
+func checkBloomKey(client *redis.Client, key string) error {
+	typ, err := client.Type(key).Result()
+	if err != nil {
+		return err
+	}
+	switch typ {
+	case "none":
+		return nil
+	case "string":
+		// HyperLogLog is a string starting with magic "HYLL"
+		head, err := client.GetRange(key, 0, 3).Result()
+		if err != nil {
+			return err
+		}
+		if head == "HYLL" {
+			return ErrBloomKeyType
+		}
+		return nil
+	}
+	return ErrBloomKeyType
+}
+
+// redisBloomFilter_Seen : Caller must guarantee req is not nil
+func (self *redisBloomFilter) Seen(req *Request) bool {
+	return self.SeenURL(self.fp.Fingerprint(req))
+}
+
+// redisBloomFilter_SeenURL test and set raw key atomically
+func (self *redisBloomFilter) SeenURL(key string) bool {
+	locs := bloomLocations(key, self.m, self.k)
+	args := make([]interface{}, len(locs))
+	for i, loc := range locs {
+		args[i] = loc
+	}
+	n, _ := redisBloomScript.Run(self.client, []string{self.key}, args...).Int64()
+	return n == int64(len(locs))
+}
+
+// redisBloomFilter_MarshalBinary dump bitmap in the same format as local bloom filter
+func (self *redisBloomFilter) MarshalBinary() ([]byte, error) {
+	bits, err := self.client.Get(self.key).Bytes()
+	if err != nil && err != redis.Nil {
+		return nil, err
+	}
+	return marshalBloom(self.m, self.k, bits), nil
+}
+
+// redisBloomFilter_UnmarshalBinary restore bitmap. size must match
+func (self *redisBloomFilter) UnmarshalBinary(data []byte) error {
+	m, k, bits, err := unmarshalBloom(data)
+	if err != nil {
+		return err
+	}
+	if m != self.m || k != self.k {
+		return ErrInvalidBloom
+	}
+	return self.client.Set(self.key, bits, 0).Err()
+}
+
+/**************************************************************
+* struct: scalableBloomFilter
+**************************************************************/
+
+// Growth parameters of scalable bloom filter: each new stage holds
+// scalableBloomGrowth times more items with fp rate tightened by scalableBloomTightening
+const (
+	scalableBloomGrowth     = 2
+	scalableBloomTightening = 0.8
+)
+
+// countingBloom is a bloom filter with 4-bit saturating counters, supports deletion
+type countingBloom struct {
+	m        uint64
+	k        uint
+	capacity uint
+	count    uint
+	counters []byte
+}
+
+func newCountingBloom(n uint, p float64) *countingBloom {
+	m, k := BloomSize(n, p)
+	return &countingBloom{m: m, k: k, capacity: n, counters: make([]byte, (m+1)/2)}
+}
+
+// countingBloom_counter returns counter at loc
+func (self *countingBloom) counter(loc uint64) byte {
+	return (self.counters[loc/2] >> (4 * (loc % 2))) & 0x0F
+}
+
+// countingBloom_add change counter at loc by delta, saturated counter never changes
+func (self *countingBloom) add(loc uint64, delta int) {
+	c := self.counter(loc)
+	if c == 0x0F || (c == 0 && delta < 0) {
+		return
+	}
+	c = byte(int(c) + delta)
+	shift := 4 * (loc % 2)
+	self.counters[loc/2] = self.counters[loc/2]&^(0x0F<<shift) | c<<shift
+}
+
+func (self *countingBloom) contains(locs []uint64) bool {
+	for _, loc := range locs {
+		if self.counter(loc) == 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// scalableBloomFilter is a chain of counting bloom filters that grows on demand
+// so total fp rate stays under p no matter how many items are added
+type scalableBloomFilter struct {
+	lock   sync.Mutex
+	p      float64
+	stages []*countingBloom
+	fp     *FingerprintOptions
+}
+
+// NewScalableBloomFilter create a growing bloom filter starting with n items capacity
+// and overall false positive rate p. it supports Unsee at cost of 4x memory
+func NewScalableBloomFilter(n uint, p float64, opts ...*FingerprintOptions) Filter {
+	if n == 0 {
+		n = 1
+	}
+	if p <= 0 || p >= 1 {
+		p = DefaultBloomFPRate
+	}
+	// sum of p0 * r^i converges to p0 / (1 - r)
+	p0 := p * (1 - scalableBloomTightening)
+	stages := []*countingBloom{newCountingBloom(n, p0)}
+	return &scalableBloomFilter{p: p, stages: stages, fp: fingerprintOptions(opts)}
+}
+
+// scalableBloomFilter_Seen : Caller must guarantee req is not nil
+func (self *scalableBloomFilter) Seen(req *Request) bool {
+	return self.SeenURL(self.fp.Fingerprint(req))
+}
+
+// scalableBloomFilter_SeenURL test and set raw key
+func (self *scalableBloomFilter) SeenURL(key string) bool {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	if self.find(key) != nil {
+		return true
+	}
+
+	last := self.stages[len(self.stages)-1]
+	if last.count >= last.capacity {
+		p := self.p * (1 - scalableBloomTightening)
+		for range self.stages {
+			p *= scalableBloomTightening
+		}
+		last = newCountingBloom(last.capacity*scalableBloomGrowth, p)
+		self.stages = append(self.stages, last)
+	}
+	for _, loc := range bloomLocations(key, last.m, last.k) {
+		last.add(loc, 1)
+	}
+	last.count++
+	return false
+}
+
+// scalableBloomFilter_Unsee implements ForgetFilter
+func (self *scalableBloomFilter) Unsee(req *Request) bool {
+	return self.UnseeURL(self.fp.Fingerprint(req))
+}
+
+// scalableBloomFilter_UnseeURL remove raw key from filter, report whether it was there
+// false positive key decrements counters of keys sharing its bits, see Forget
+func (self *scalableBloomFilter) UnseeURL(key string) bool {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	stage := self.find(key)
+	if stage == nil {
+		return false
+	}
+	for _, loc := range bloomLocations(key, stage.m, stage.k) {
+		stage.add(loc, -1)
+	}
+	stage.count--
+	return true
+}
+
+// scalableBloomFilter_Len implements LenFilter
+func (self *scalableBloomFilter) Len() (n int) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	for _, stage := range self.stages {
+		n += int(stage.count)
+	}
+	return
+}
+
+// scalableBloomFilter_find returns stage that contains key, newest first
+func (self *scalableBloomFilter) find(key string) *countingBloom {
+	for i := len(self.stages) - 1; i >= 0; i-- {
+		stage := self.stages[i]
+		if stage.contains(bloomLocations(key, stage.m, stage.k)) {
+			return stage
+		}
+	}
+	return nil
+}
@@ -0,0 +1,146 @@
+package gospider
+
+import (
+	"bytes"
+	"fmt"
+	"testing"
+	"github.com/alicebob/miniredis/v2"
+)
+
+func TestBloomSize(t *testing.T) {
+	m, k := BloomSize(1000000, 0.01)
+	if m != 9585059 || k != 7 {
+		t.Errorf("wrong bloom size m=%d k=%d", m, k)
+	}
+}
+
+func TestBloomFilter(t *testing.T) {
+	n := 10000
+	filter := NewBloomFilter(uint(n), 0.01).(*bloomFilter)
+	for i := 0; i < n; i++ {
+		if filter.SeenURL(fmt.Sprintf("http://a.com/%d", i)) && i < 10 {
+			t.Error("you can not see what you haven't seen")
+		}
+	}
+	for i := 0; i < n; i++ {
+		if !filter.SeenURL(fmt.Sprintf("http://a.com/%d", i)) {
+			t.Fatal("bloom filter should never have false negative")
+		}
+	}
+
+	fp := 0
+	for i := 0; i < n; i++ {
+		if filter.contains(fmt.Sprintf("http://b.com/%d", i)) {
+			fp++
+		}
+	}
+	if rate := float64(fp) / float64(n); rate > 0.02 {
+		t.Errorf("false positive rate %f too high", rate)
+	}
+
+	data, _ := filter.MarshalBinary()
+	restored := NewBloomFilter(1, 0.5).(*bloomFilter)
+	if err := restored.UnmarshalBinary(data); err != nil {
+		t.Fatal(err)
+	}
+	if !restored.SeenURL("http://a.com/0") {
+		t.Error("bloom filter state should be restored")
+	}
+
+	// Len is estimated from bits after restored
+	if l := restored.Len(); l < n*95/100 || l > n*105/100 {
+		t.Errorf("wrong estimated len %d", l)
+	}
+	if stats := filter.Stats(); stats.Len > n || stats.Len < n*99/100 || stats.FPRate > 0.02 || stats.Bytes != len(filter.bits) {
+		t.Errorf("wrong bloom filter stats %+v", stats)
+	}
+	var buf bytes.Buffer
+	if err := filter.Save(&buf); err != nil {
+		t.Fatal(err)
+	}
+	loaded := NewBloomFilter(1, 0.5).(*bloomFilter)
+	if err := loaded.Load(&buf); err != nil || !loaded.contains("http://a.com/1") {
+		t.Error("bloom filter should be loaded")
+	}
+}
+
+func TestRedisBloomFilterBitmap(t *testing.T) {
+	server, err := miniredis.Run()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+
+	filter, err := NewRedisBloomFilterSize("redis://"+server.Addr(), "test:bloom", 1000, 0.01)
+	if err != nil {
+		t.Fatal(err)
+	}
+	reqA, _ := NewGetRequest("http://a.com")
+	reqB, _ := NewGetRequest("http://b.com")
+	if filter.Seen(reqA) || filter.Seen(reqB) {
+		t.Error("you can not see what you haven't seen")
+	}
+	if !filter.Seen(reqA) || !filter.Seen(reqB) {
+		t.Error("blind on what already seen")
+	}
+
+	// bitmap lives aside HyperLogLog of former filter, other data is refused
+	server.Set("test:bloom", "HYLL")
+	if _, err := server.Get("test:bloom" + redisBloomSuffix); err != nil {
+		t.Error("bitmap should be stored at suffixed key")
+	}
+	server.Lpush("test:list"+redisBloomSuffix, "a")
+	server.Set("test:hll"+redisBloomSuffix, "HYLL")
+	for _, key := range []string{"test:list", "test:hll"} {
+		if _, err := NewRedisBloomFilter("redis://"+server.Addr(), key); err != ErrBloomKeyType {
+			t.Errorf("filter on %s should be refused: %v", key, err)
+		}
+	}
+
+	// redis bitmap and local bloom filter share same format
+	data, err := filter.(*redisBloomFilter).MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+	local := NewBloomFilter(1, 0.5).(*bloomFilter)
+	if err = local.UnmarshalBinary(data); err != nil {
+		t.Fatal(err)
+	}
+	reqC, _ := NewGetRequest("http://c.com")
+	if !local.Seen(reqA) || local.Seen(reqC) {
+		t.Error("local filter should restore redis bitmap")
+	}
+}
+
+func TestScalableBloomFilter(t *testing.T) {
+	n := 10000
+	filter := NewScalableBloomFilter(100, 0.01).(*scalableBloomFilter)
+	seen := 0
+	for i := 0; i < n; i++ {
+		if filter.SeenURL(fmt.Sprintf("http://a.com/%d", i)) {
+			seen++
+		}
+	}
+	if len(filter.stages) < 5 {
+		t.Errorf("filter should grow, got %d stages", len(filter.stages))
+	}
+	if rate := float64(seen) / float64(n); rate > 0.01 {
+		t.Errorf("false positive rate %f too high", rate)
+	}
+	for i := 0; i < n; i++ {
+		if !filter.SeenURL(fmt.Sprintf("http://a.com/%d", i)) {
+			t.Fatal("bloom filter should never have false negative")
+		}
+	}
+
+	req, _ := NewGetRequest("http://a.com/forget")
+	if filter.Seen(req) || !filter.Seen(req) {
+		t.Error("wrong seen state before forget")
+	}
+	if !filter.Unsee(req) || filter.Unsee(req) {
+		t.Error("wrong unsee result")
+	}
+	if filter.Seen(req) {
+		t.Error("forgotten request should not be seen")
+	}
+}
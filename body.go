@@ -0,0 +1,154 @@
+package gospider
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"sync"
+)
+
+/**************************************************************
+* struct: BodyPolicy
+**************************************************************/
+
+// BodyPolicy limits response body size and spools large bodies to disk
+type BodyPolicy struct {
+	// MaxSize is max decoded body bytes kept, the rest is discarded and Response.Truncated is set
+	// response with larger Content-Length is aborted with ErrBodyTooLarge.
+	// compressed body is decoded first, so only its decoded size counts.
+	// zero means unlimited. Meta[KeyMaxSize] overrides it per request
+	MaxSize int64
+
+	// StreamSize is threshold above which body is written to a temp file
+	// zero disables streaming unless Meta[KeyStream] is true
+	StreamSize int64
+
+	// TempDir is where temp files are created, empty for os.TempDir
+	TempDir string
+}
+
+// bodyMiddleware applies BodyPolicy on responses
+type bodyMiddleware struct {
+	NopDownloaderMiddleware
+	policy BodyPolicy
+}
+
+// NewBodyMiddleware limits and spools response bodies according to policy
+func NewBodyMiddleware(policy BodyPolicy) DownloaderMiddleware {
+	return &bodyMiddleware{policy: policy}
+}
+
+func (self *bodyMiddleware) ProcessResponse(req *Request, res *Response) (Data, error) {
+	if res == nil || res.Response == nil || res.Response.Body == nil {
+		return nil, nil
+	}
+
+	// limit applies to decoded bytes, whichever downloader fetched it
+	if err := decodeContent(res.Response); err != nil {
+		return nil, err
+	}
+
+	maxSize := self.policy.MaxSize
+	if n, ok := req.Meta.GetInt(KeyMaxSize); ok {
+		maxSize = int64(n)
+	}
+	if maxSize > 0 {
+		if res.ContentLength > maxSize {
+			res.Response.Body.Close()
+			return nil, fmt.Errorf("%w: content length %d exceeds %d", ErrBodyTooLarge, res.ContentLength, maxSize)
+		}
+		res.Response.Body = &limitBody{ReadCloser: res.Response.Body, remain: maxSize, res: res}
+	}
+
+	stream, _ := req.Meta[KeyStream].(bool)
+	if !stream && self.policy.StreamSize <= 0 {
+		return nil, nil
+	}
+	if err := self.spool(res, stream); err != nil {
+		return nil, err
+	}
+	return nil, nil
+}
+
+// bodyMiddleware_spool write body to temp file if it is large or forced
+// body no larger than StreamSize is kept in memory
+func (self *bodyMiddleware) spool(res *Response, force bool) error {
+	body := res.Response.Body
+	defer body.Close()
+
+	var head []byte
+	if !force && (res.ContentLength < 0 || res.ContentLength <= self.policy.StreamSize) {
+		buf, err := ioutil.ReadAll(io.LimitReader(body, self.policy.StreamSize+1))
+		if err != nil {
+			return err
+		}
+		if int64(len(buf)) <= self.policy.StreamSize {
+			res.Response.Body = ioutil.NopCloser(bytes.NewReader(buf))
+			return nil
+		}
+		head = buf
+	}
+
+	file, err := ioutil.TempFile(self.policy.TempDir, "gospider-body-")
+	if err != nil {
+		return err
+	}
+	if _, err = file.Write(head); err == nil {
+		_, err = io.Copy(file, body)
+	}
+	if err == nil {
+		_, err = file.Seek(0, io.SeekStart)
+	}
+	if err != nil {
+		file.Close()
+		os.Remove(file.Name())
+		return err
+	}
+	res.Response.Body = &fileBody{File: file}
+	res.BodyFile = file.Name()
+	return nil
+}
+
+/**************************************************************
+* struct: limitBody & fileBody
+**************************************************************/
+
+// limitBody reads at most remain bytes and marks response truncated if there is more
+type limitBody struct {
+	io.ReadCloser
+	remain int64
+	res    *Response
+}
+
+func (self *limitBody) Read(b []byte) (n int, err error) {
+	if self.remain <= 0 {
+		// probe whether anything is left, reader may return (0, nil) before EOF
+		var probe [1]byte
+		if m, _ := io.ReadAtLeast(self.ReadCloser, probe[:], 1); m > 0 {
+			self.res.Truncated = true
+		}
+		return 0, io.EOF
+	}
+	if int64(len(b)) > self.remain {
+		b = b[:self.remain]
+	}
+	n, err = self.ReadCloser.Read(b)
+	self.remain -= int64(n)
+	return
+}
+
+// fileBody is body backed by temp file, which is removed on Close
+type fileBody struct {
+	*os.File
+	once sync.Once
+}
+
+func (self *fileBody) Close() (err error) {
+	self.once.Do(func() {
+		err = self.File.Close()
+		os.Remove(self.File.Name())
+	})
+	return
+}
@@ -0,0 +1,132 @@
+package gospider
+
+import (
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestBodyMiddleware(t *testing.T) {
+	// /chunked streams body without Content-Length
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body := strings.Repeat("x", 1000)
+		if r.URL.Path == "/chunked" {
+			w.Write([]byte(body[:500]))
+			w.(http.Flusher).Flush()
+			w.Write([]byte(body[500:]))
+			return
+		}
+		w.Write([]byte(body))
+	}))
+	defer server.Close()
+
+	download := func(policy BodyPolicy, path string, meta MetaMap) (*Response, string, error) {
+		downloader, _ := NewDownloader(nil, NewBodyMiddleware(policy))
+		req, _ := NewRequest("GET", server.URL+path, nil, meta)
+		res, err := downloader.Download(req)
+		if err != nil {
+			return res, "", err
+		}
+		body, _ := ioutil.ReadAll(res.Response.Body)
+		return res, string(body), nil
+	}
+
+	// early abort on Content-Length
+	if _, _, err := download(BodyPolicy{MaxSize: 100}, "/", nil); !errors.Is(err, ErrBodyTooLarge) || !errors.Is(err, ErrDropRequest) {
+		t.Errorf("large body should be aborted, got %v", err)
+	}
+
+	// truncated when size is unknown
+	res, body, err := download(BodyPolicy{MaxSize: 100}, "/chunked", nil)
+	if err != nil || len(body) != 100 || !res.Truncated {
+		t.Errorf("chunked body should be truncated: %d %v %v", len(body), res.Truncated, err)
+	}
+	res, body, _ = download(BodyPolicy{MaxSize: 1000}, "/chunked", nil)
+	if len(body) != 1000 || res.Truncated {
+		t.Error("body within limit should not be truncated")
+	}
+
+	// per request override
+	if _, body, err = download(BodyPolicy{MaxSize: 100}, "/", MetaMap{KeyMaxSize: 2000}); err != nil || len(body) != 1000 {
+		t.Errorf("meta max size should override policy: %v", err)
+	}
+
+	// small body stays in memory
+	res, body, _ = download(BodyPolicy{StreamSize: 2000}, "/chunked", nil)
+	if res.BodyFile != "" || len(body) != 1000 {
+		t.Error("small body should not be streamed")
+	}
+
+	// large body is streamed to file, removed after close
+	dir := t.TempDir()
+	for _, path := range []string{"/", "/chunked"} {
+		res, body, err = download(BodyPolicy{StreamSize: 500, TempDir: dir}, path, nil)
+		if err != nil || res.BodyFile == "" || len(body) != 1000 {
+			t.Fatalf("large body should be streamed to file: %v", err)
+		}
+		res.Response.Body.Close()
+		if _, err := os.Stat(res.BodyFile); !os.IsNotExist(err) {
+			t.Error("temp file should be removed when body is closed")
+		}
+	}
+
+	// forced streaming with limit
+	res, body, _ = download(BodyPolicy{MaxSize: 300, TempDir: dir}, "/chunked", MetaMap{KeyStream: true})
+	if res.BodyFile == "" || len(body) != 300 || !res.Truncated {
+		t.Error("forced streaming should keep truncated body in file")
+	}
+	res.Response.Body.Close()
+}
+
+// stallReader returns (0, nil) stalls times before reading from Reader
+type stallReader struct {
+	io.Reader
+	stalls int
+}
+
+func (self *stallReader) Read(b []byte) (int, error) {
+	if self.stalls > 0 {
+		self.stalls--
+		return 0, nil
+	}
+	return self.Reader.Read(b)
+}
+
+func TestBodyMiddlewareDecoded(t *testing.T) {
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	gz.Write([]byte(strings.Repeat("x", 1000)))
+	gz.Close()
+
+	// downloader without decoding, compressed length is far below the limit
+	gzipped := downloaderFunc(func(req *Request) (*Response, error) {
+		res := FakeResponse(req.URL.String(), "")
+		res.Response.Body = ioutil.NopCloser(bytes.NewReader(buf.Bytes()))
+		res.ContentLength = int64(buf.Len())
+		res.Header.Set("Content-Encoding", "gzip")
+		return res, nil
+	})
+	req, _ := NewGetRequest("http://a.com/")
+	res, err := NewDownloaderChain(gzipped, NewBodyMiddleware(BodyPolicy{MaxSize: 100})).Download(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := ioutil.ReadAll(res.Response.Body)
+	if len(body) != 100 || body[0] != 'x' || !res.Truncated {
+		t.Errorf("limit should apply to decoded body: %d %v", len(body), res.Truncated)
+	}
+
+	// reader stalls right at the limit
+	res = FakeResponse("http://a.com/", "")
+	limited := &limitBody{ReadCloser: ioutil.NopCloser(&stallReader{strings.NewReader("xyz"), 3}), remain: 0, res: res}
+	if n, err := limited.Read(make([]byte, 10)); n != 0 || err != io.EOF || !res.Truncated {
+		t.Errorf("stalled probe should still mark truncated: %d %v %v", n, err, res.Truncated)
+	}
+}
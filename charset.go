@@ -0,0 +1,182 @@
+package gospider
+
+import (
+	"bufio"
+	"compress/flate"
+	"compress/gzip"
+	"compress/zlib"
+	"io"
+	"net/http"
+	"strings"
+	"unicode/utf8"
+	"github.com/andybalholm/brotli"
+	"golang.org/x/net/html/charset"
+	"golang.org/x/text/encoding"
+	"golang.org/x/text/encoding/simplifiedchinese"
+)
+
+/**************************************************************
+* content encoding: gzip, deflate, br
+**************************************************************/
+
+// acceptEncoding is sent by downloader when request does not set Accept-Encoding
+const acceptEncoding = "gzip, deflate, br"
+
+// decodedBody reads decoded content and closes both decoders and origin body
+type decodedBody struct {
+	io.Reader
+	closers []io.Closer
+}
+
+func (self *decodedBody) Close() (err error) {
+	for i := len(self.closers) - 1; i >= 0; i-- {
+		if e := self.closers[i].Close(); e != nil && err == nil {
+			err = e
+		}
+	}
+	return
+}
+
+// decodeContent replace body of res with decoded one according to Content-Encoding
+// unknown encoding is left as is. Content-Encoding & Content-Length are removed once decoded
+func decodeContent(res *http.Response) error {
+	if res == nil || res.Body == nil {
+		return nil
+	}
+	header := res.Header.Get("Content-Encoding")
+	if header == "" {
+		return nil
+	}
+	codings := strings.Split(header, ",")
+	for _, c := range codings {
+		switch strings.ToLower(strings.TrimSpace(c)) {
+		case "gzip", "x-gzip", "deflate", "br", "identity":
+		default:
+			return nil
+		}
+	}
+
+	body := &decodedBody{Reader: res.Body, closers: []io.Closer{res.Body}}
+	// codings are listed in the order they were applied
+	for i := len(codings) - 1; i >= 0; i-- {
+		var err error
+		switch strings.ToLower(strings.TrimSpace(codings[i])) {
+		case "gzip", "x-gzip":
+			var r *gzip.Reader
+			if r, err = gzip.NewReader(body.Reader); err == nil {
+				body.Reader, body.closers = r, append(body.closers, r)
+			}
+		case "deflate":
+			var r io.ReadCloser
+			if r, err = newDeflateReader(body.Reader); err == nil {
+				body.Reader, body.closers = r, append(body.closers, r)
+			}
+		case "br":
+			body.Reader = brotli.NewReader(body.Reader)
+		}
+		if err != nil {
+			body.Close()
+			return err
+		}
+	}
+
+	res.Body = body
+	res.Header.Del("Content-Encoding")
+	res.Header.Del("Content-Length")
+	res.ContentLength = -1
+	res.Uncompressed = true
+	return nil
+}
+
+// newDeflateReader reads deflate content with or without zlib wrapper
+// RFC says deflate means zlib format, yet some servers send raw deflate
+func newDeflateReader(r io.Reader) (io.ReadCloser, error) {
+	br := bufio.NewReader(r)
+	head, err := br.Peek(2)
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+	if len(head) == 2 && head[0]&0x0f == 8 && (uint16(head[0])<<8|uint16(head[1]))%31 == 0 {
+		return zlib.NewReader(br)
+	}
+	return flate.NewReader(br), nil
+}
+
+/**************************************************************
+* charset: detect & decode
+**************************************************************/
+
+// detectCharset find out encoding of body from content type, <meta> and byte sniffing
+// GBK & GB2312 are upgraded to GB18030, which is a superset of both
+// body that is neither valid UTF-8 nor GB18030 falls back to windows-1252
+func detectCharset(body []byte, contentType string) (encoding.Encoding, string) {
+	e, name, certain := charset.DetermineEncoding(body, contentType)
+	switch {
+	case name == "gbk":
+		return simplifiedchinese.GB18030, "gb18030"
+	case certain || name != "windows-1252":
+		return e, name
+	case isASCII(body):
+		return encoding.Nop, "utf-8"
+	case sniffGB18030(body):
+		return simplifiedchinese.GB18030, "gb18030"
+	}
+	return e, name
+}
+
+// isASCII tells whether body has only 7-bit bytes
+func isASCII(body []byte) bool {
+	for _, b := range body {
+		if b >= utf8.RuneSelf {
+			return false
+		}
+	}
+	return true
+}
+
+// decodeText decode body to UTF-8 string, undecodable bytes become U+FFFD
+func decodeText(body []byte, contentType string) (string, error) {
+	e, _ := detectCharset(body, contentType)
+	if e == encoding.Nop {
+		return string(body), nil
+	}
+	text, err := e.NewDecoder().Bytes(body)
+	if err != nil {
+		return "", err
+	}
+	return string(text), nil
+}
+
+// sniffGB18030 tells whether non-ascii bytes of body all form GB18030 sequences
+// an incomplete sequence at the end is allowed since body may be truncated
+func sniffGB18030(body []byte) bool {
+	multi := 0
+	for i := 0; i < len(body); {
+		b := body[i]
+		if b < utf8.RuneSelf {
+			i++
+			continue
+		}
+		rest := body[i+1:]
+		switch {
+		case b < 0x81 || b > 0xfe:
+			return false
+		case len(rest) == 0:
+			return multi > 0
+		case rest[0] >= 0x40 && rest[0] <= 0xfe && rest[0] != 0x7f:
+			i += 2
+		case rest[0] >= 0x30 && rest[0] <= 0x39:
+			if len(rest) < 3 {
+				return multi > 0
+			}
+			if rest[1] < 0x81 || rest[1] > 0xfe || rest[2] < 0x30 || rest[2] > 0x39 {
+				return false
+			}
+			i += 4
+		default:
+			return false
+		}
+		multi++
+	}
+	return multi > 0
+}
@@ -0,0 +1,137 @@
+package gospider
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"compress/zlib"
+	"context"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"github.com/andybalholm/brotli"
+	"golang.org/x/text/encoding/simplifiedchinese"
+)
+
+func TestResponseText(t *testing.T) {
+	const text = "豌豆荚 应用商店"
+	gbk, _ := simplifiedchinese.GBK.NewEncoder().String(text)
+
+	cases := []struct {
+		contentType, body, charset string
+	}{
+		{"text/html; charset=utf-8", text, "utf-8"},
+		{"text/html; charset=GBK", gbk, "gb18030"},
+		{"text/html; charset=gb2312", gbk, "gb18030"},
+		{"text/html", `<html><head><meta charset="gbk"></head>` + gbk, "gb18030"},
+		{"text/html", `<meta http-equiv="Content-Type" content="text/html; charset=gb2312">` + gbk, "gb18030"},
+		{"", gbk, "gb18030"},
+		{"", text, "utf-8"},
+		{"", "plain ascii", "utf-8"},
+	}
+	for _, c := range cases {
+		res := FakeResponse("http://x.com/", c.body)
+		res.Header.Set("Content-Type", c.contentType)
+		if got := res.Charset(); got != c.charset {
+			t.Errorf("charset of %q should be %s, got %s", c.body, c.charset, got)
+		}
+		want := text
+		if c.body == "plain ascii" {
+			want = c.body
+		}
+		if got, err := res.Text(); err != nil || !bytes.HasSuffix([]byte(got), []byte(want)) {
+			t.Errorf("text of %q should end with %q, got %q, %v", c.body, want, got, err)
+		}
+	}
+
+	// body truncated in the middle of a character is still sniffed
+	if !sniffGB18030([]byte(gbk[:len(gbk)-1])) || sniffGB18030([]byte("\xff\xfe")) {
+		t.Error("sniff gb18030 failed")
+	}
+}
+
+func TestResponseReplay(t *testing.T) {
+	res := FakeResponse("http://x.com/", "hello")
+	if body, err := res.Body(); err != nil || string(body) != "hello" {
+		t.Fatalf("wrong body: %s, %v", body, err)
+	}
+	// every reader reading until EOF gets whole body
+	for i := 0; i < 3; i++ {
+		if body, _ := ioutil.ReadAll(res.Response.Body); string(body) != "hello" {
+			t.Errorf("body should be re-readable, got %q", body)
+		}
+	}
+	res.Response.Body.Close()
+	if items, _ := BodyReader(res); items[0].(Item)[KeyBody] != "hello" {
+		t.Error("body should be readable after close")
+	}
+
+	// reader stopping early never affects the next consumer
+	early := res.Response.Body
+	early.Read(make([]byte, 2))
+	res.Body()
+	if body, _ := ioutil.ReadAll(res.Response.Body); string(body) != "hello" {
+		t.Errorf("body should be rewound by Body, got %q", body)
+	}
+	if rest, _ := ioutil.ReadAll(early); string(rest) != "llo" {
+		t.Errorf("reader handed out before should be kept, got %q", rest)
+	}
+	res.Response.Body.Read(make([]byte, 2))
+	parser := func(res *Response) ([]Data, error) {
+		body, err := ioutil.ReadAll(res.Response.Body)
+		return []Data{Item{KeyBody: string(body)}}, err
+	}
+	if data, _ := parseContext(context.Background(), parser, res); data[0].(Item)[KeyBody] != "hello" {
+		t.Errorf("parser should read body from beginning, got %v", data[0])
+	}
+}
+
+func TestDownloaderDecode(t *testing.T) {
+	const text = "compressed content 压缩内容"
+	encoders := map[string]func(w io.Writer) io.WriteCloser{
+		"gzip":    func(w io.Writer) io.WriteCloser { return gzip.NewWriter(w) },
+		"deflate": func(w io.Writer) io.WriteCloser { return zlib.NewWriter(w) },
+		"raw":     func(w io.Writer) io.WriteCloser { z, _ := flate.NewWriter(w, flate.DefaultCompression); return z },
+		"br":      func(w io.Writer) io.WriteCloser { return brotli.NewWriter(w) },
+	}
+
+	var accept string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		accept = r.Header.Get("Accept-Encoding")
+		coding := r.URL.Path[1:]
+		var buf bytes.Buffer
+		z := encoders[coding](&buf)
+		z.Write([]byte(text))
+		z.Close()
+		if coding == "raw" {
+			coding = "deflate"
+		}
+		w.Header().Set("Content-Encoding", coding)
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		w.Write(buf.Bytes())
+	}))
+	defer server.Close()
+
+	downloader, _ := NewDownloader(nil)
+	for coding := range encoders {
+		req, _ := NewGetRequest(server.URL + "/" + coding)
+		res, err := downloader.Download(req)
+		if err != nil {
+			t.Fatalf("download %s failed: %s", coding, err)
+		}
+		if got, err := res.Text(); err != nil || got != text {
+			t.Errorf("%s body should be decoded, got %q, %v", coding, got, err)
+		}
+		if res.Header.Get("Content-Encoding") != "" || res.ContentLength != -1 {
+			t.Errorf("%s content encoding should be removed once decoded", coding)
+		}
+		if req.Header.Get("Accept-Encoding") != "" {
+			t.Error("origin request header should not be changed")
+		}
+	}
+	if accept != acceptEncoding {
+		t.Errorf("downloader should accept %s, got %s", acceptEncoding, accept)
+	}
+}
@@ -0,0 +1,242 @@
+package gospider
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/cookiejar"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+/**************************************************************
+* struct: CookieSessions
+**************************************************************/
+
+// DefaultSession is name of session used by requests without Meta[KeySession]
+const DefaultSession = ""
+
+// CookieSessions holds a cookie jar for each named session
+// so different logins or identities never share cookies
+type CookieSessions struct {
+	lock sync.Mutex
+	jars map[string]*sessionJar
+}
+
+// NewCookieSessions create an empty session manager
+func NewCookieSessions() *CookieSessions {
+	return &CookieSessions{jars: make(map[string]*sessionJar)}
+}
+
+// CookieSessions_Jar returns jar of session, created on demand
+func (self *CookieSessions) Jar(name string) http.CookieJar {
+	return self.jar(name)
+}
+
+// CookieSessions_Remove drop session and all its cookies
+func (self *CookieSessions) Remove(name string) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	delete(self.jars, name)
+}
+
+// CookieSessions_Names returns names of existing sessions
+func (self *CookieSessions) Names() []string {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	names := make([]string, 0, len(self.jars))
+	for name := range self.jars {
+		names = append(names, name)
+	}
+	return names
+}
+
+// CookieSessions_Export write unexpired cookies of session in Netscape cookies.txt format
+func (self *CookieSessions) Export(name string, w io.Writer) error {
+	bw := bufio.NewWriter(w)
+	fmt.Fprint(bw, "# Netscape HTTP Cookie File\n")
+	for _, c := range self.jar(name).records() {
+		domain, sub := c.Domain, "FALSE"
+		if !c.HostOnly {
+			domain, sub = "."+domain, "TRUE"
+		}
+		if c.HttpOnly {
+			domain = "#HttpOnly_" + domain
+		}
+		var expires int64
+		if !c.Expires.IsZero() {
+			expires = c.Expires.Unix()
+		}
+		fmt.Fprintf(bw, "%s\t%s\t%s\t%s\t%d\t%s\t%s\n",
+			domain, sub, c.Path, strings.ToUpper(strconv.FormatBool(c.Secure)), expires, c.Name, c.Value)
+	}
+	return bw.Flush()
+}
+
+// CookieSessions_Import add cookies in Netscape cookies.txt format to session
+// expired cookies are skipped, expiry 0 means session cookie
+func (self *CookieSessions) Import(name string, r io.Reader) error {
+	jar := self.jar(name)
+	scanner := bufio.NewScanner(r)
+	now := time.Now()
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimRight(scanner.Text(), "\r")
+		httpOnly := false
+		if strings.HasPrefix(text, "#HttpOnly_") {
+			text, httpOnly = strings.TrimPrefix(text, "#HttpOnly_"), true
+		}
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		fields := strings.Split(text, "\t")
+		if len(fields) != 7 {
+			return fmt.Errorf("%w: cookies.txt line %d", ErrInvalidCookie, line)
+		}
+		expires, err := strconv.ParseInt(fields[4], 10, 64)
+		if err != nil {
+			return fmt.Errorf("%w: cookies.txt line %d", ErrInvalidCookie, line)
+		}
+
+		host := strings.TrimPrefix(strings.ToLower(fields[0]), ".")
+		secure := strings.EqualFold(fields[3], "TRUE")
+		c := &http.Cookie{
+			Name:     fields[5],
+			Value:    fields[6],
+			Path:     fields[2],
+			Secure:   secure,
+			HttpOnly: httpOnly,
+		}
+		if strings.EqualFold(fields[1], "TRUE") {
+			c.Domain = host
+		}
+		if expires > 0 {
+			c.Expires = time.Unix(expires, 0)
+			if !c.Expires.After(now) {
+				continue
+			}
+		}
+		scheme := "http"
+		if secure {
+			scheme = "https"
+		}
+		jar.SetCookies(&url.URL{Scheme: scheme, Host: host, Path: c.Path}, []*http.Cookie{c})
+	}
+	return scanner.Err()
+}
+
+// CookieSessions_jar find or create jar of session
+func (self *CookieSessions) jar(name string) *sessionJar {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	jar, ok := self.jars[name]
+	if !ok {
+		jar = newSessionJar()
+		self.jars[name] = jar
+	}
+	return jar
+}
+
+/**************************************************************
+* struct: sessionJar
+**************************************************************/
+
+// cookieRecord is a stored cookie with attributes needed by cookies.txt
+type cookieRecord struct {
+	http.Cookie
+	HostOnly bool
+}
+
+// sessionJar is cookiejar.Jar that also keeps cookies for export
+// cookiejar.Jar does matching, while records only mirror what it stores
+type sessionJar struct {
+	*cookiejar.Jar
+	lock    sync.Mutex
+	entries map[string]*cookieRecord
+}
+
+func newSessionJar() *sessionJar {
+	jar, _ := cookiejar.New(nil)
+	return &sessionJar{Jar: jar, entries: make(map[string]*cookieRecord)}
+}
+
+// sessionJar_SetCookies implements http.CookieJar
+func (self *sessionJar) SetCookies(u *url.URL, cookies []*http.Cookie) {
+	self.Jar.SetCookies(u, cookies)
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return
+	}
+
+	host := strings.ToLower(u.Hostname())
+	now := time.Now()
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	for _, c := range cookies {
+		r := &cookieRecord{Cookie: *c}
+		// domain attribute is ignored for ip host
+		if c.Domain == "" || net.ParseIP(host) != nil {
+			r.Domain, r.HostOnly = host, true
+		} else {
+			r.Domain = strings.TrimPrefix(strings.ToLower(c.Domain), ".")
+			if host != r.Domain && !strings.HasSuffix(host, "."+r.Domain) {
+				continue
+			}
+		}
+		if r.Path == "" || r.Path[0] != '/' {
+			r.Path = cookieDefaultPath(u.Path)
+		}
+		key := r.Domain + ";" + r.Path + ";" + r.Name
+
+		switch {
+		case c.MaxAge < 0:
+			delete(self.entries, key)
+			continue
+		case c.MaxAge > 0:
+			r.Expires = now.Add(time.Duration(c.MaxAge) * time.Second)
+		case !c.Expires.IsZero() && !c.Expires.After(now):
+			delete(self.entries, key)
+			continue
+		}
+		self.entries[key] = r
+	}
+}
+
+// sessionJar_records returns unexpired cookies
+func (self *sessionJar) records() []*cookieRecord {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	now := time.Now()
+	list := make([]*cookieRecord, 0, len(self.entries))
+	for key, r := range self.entries {
+		if !r.Expires.IsZero() && !r.Expires.After(now) {
+			delete(self.entries, key)
+			continue
+		}
+		list = append(list, r)
+	}
+	sort.Slice(list, func(i, j int) bool {
+		a, b := list[i], list[j]
+		if a.Domain != b.Domain {
+			return a.Domain < b.Domain
+		}
+		if a.Path != b.Path {
+			return a.Path < b.Path
+		}
+		return a.Name < b.Name
+	})
+	return list
+}
+
+// cookieDefaultPath is default cookie path of request path, see RFC 6265 5.1.4
+func cookieDefaultPath(path string) string {
+	i := strings.LastIndex(path, "/")
+	if len(path) == 0 || path[0] != '/' || i == 0 {
+		return "/"
+	}
+	return path[:i]
+}
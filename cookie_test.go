@@ -0,0 +1,110 @@
+package gospider
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestDownloaderSessions(t *testing.T) {
+	// /login?user=x sets cookie, other pages echo it
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if user := r.URL.Query().Get("user"); user != "" {
+			http.SetCookie(w, &http.Cookie{Name: "user", Value: user, Path: "/", MaxAge: 3600, HttpOnly: true})
+			http.Redirect(w, r, "/home", http.StatusFound)
+			return
+		}
+		if c, err := r.Cookie("user"); err == nil {
+			fmt.Fprint(w, c.Value)
+		}
+	}))
+	defer server.Close()
+
+	downloader, _ := NewDownloader(nil)
+	fetch := func(path, session string) string {
+		meta := MetaMap{}
+		if session != "" {
+			meta[KeySession] = session
+		}
+		req, _ := NewRequest("GET", server.URL+path, nil, meta)
+		res, err := downloader.Download(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		text, _ := res.Text()
+		return text
+	}
+
+	// cookie set before redirect is kept
+	if got := fetch("/login?user=alice", "alice"); got != "alice" {
+		t.Errorf("session cookie should follow redirect, got %q", got)
+	}
+	fetch("/login?user=bob", "bob")
+	fetch("/login?user=anon", "")
+	if fetch("/", "alice") != "alice" || fetch("/", "bob") != "bob" || fetch("/", "") != "anon" {
+		t.Error("sessions should keep separate cookies")
+	}
+
+	// export alice and import as carol
+	sessions := SessionsOf(downloader)
+	var buf bytes.Buffer
+	if err := sessions.Export("alice", &buf); err != nil {
+		t.Fatal(err)
+	}
+	u, _ := url.Parse(server.URL)
+	if !strings.Contains(buf.String(), "#HttpOnly_"+u.Hostname()+"\tFALSE\t/\tFALSE\t") {
+		t.Errorf("wrong cookies.txt:\n%s", buf.String())
+	}
+	if err := sessions.Import("carol", &buf); err != nil {
+		t.Fatal(err)
+	}
+	if got := fetch("/", "carol"); got != "alice" {
+		t.Errorf("imported session should send cookies, got %q", got)
+	}
+}
+
+func TestCookieSessionsImport(t *testing.T) {
+	txt := "# Netscape HTTP Cookie File\n" +
+		".example.com\tTRUE\t/\tFALSE\t0\tsid\t123\n" +
+		"www.example.com\tFALSE\t/app\tTRUE\t4102444800\ttoken\tabc\n" +
+		"old.example.com\tFALSE\t/\tFALSE\t1\texpired\tx\n"
+	sessions := NewCookieSessions()
+	if err := sessions.Import("s", strings.NewReader(txt)); err != nil {
+		t.Fatal(err)
+	}
+	jar := sessions.Jar("s")
+	cookies := func(raw string) string {
+		u, _ := url.Parse(raw)
+		var list []string
+		for _, c := range jar.Cookies(u) {
+			list = append(list, c.Name)
+		}
+		return strings.Join(list, ",")
+	}
+	if got := cookies("http://sub.example.com/"); got != "sid" {
+		t.Errorf("domain cookie should match sub domain, got %s", got)
+	}
+	if got := cookies("https://www.example.com/app/x"); got != "token,sid" && got != "sid,token" {
+		t.Errorf("secure host cookie should match, got %s", got)
+	}
+	if got := cookies("http://www.example.com/app/x"); got != "sid" {
+		t.Errorf("secure cookie should not be sent over http, got %s", got)
+	}
+
+	var buf bytes.Buffer
+	sessions.Export("s", &buf)
+	want := "# Netscape HTTP Cookie File\n" +
+		".example.com\tTRUE\t/\tFALSE\t0\tsid\t123\n" +
+		"www.example.com\tFALSE\t/app\tTRUE\t4102444800\ttoken\tabc\n"
+	if buf.String() != want {
+		t.Errorf("export should round trip:\n%s", buf.String())
+	}
+
+	if err := sessions.Import("s", strings.NewReader("bad line\n")); err == nil {
+		t.Error("malformed cookies.txt should be rejected")
+	}
+}
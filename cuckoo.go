@@ -0,0 +1,252 @@
+package gospider
+
+import (
+	"hash/fnv"
+	"math/rand"
+	"sync"
+)
+
+/**************************************************************
+* cuckoo: parameters & hashing
+**************************************************************/
+
+const (
+	// cuckooBucketSize is number of fingerprints per bucket
+	cuckooBucketSize = 4
+
+	// cuckooMaxKicks is max relocations before insertion fails
+	cuckooMaxKicks = 500
+
+	// cuckooLoadFactor is expected max load of table with 4-way buckets
+	cuckooLoadFactor = 0.95
+)
+
+type cuckooBucket [cuckooBucketSize]uint16
+
+// cuckooHash returns 16-bit non-zero fingerprint and primary bucket index of key
+func cuckooHash(key string, mask uint64) (fp uint16, i1 uint64) {
+	h := fnv.New64a()
+	h.Write([]byte(key))
+	sum := cuckooMix(h.Sum64())
+	fp = uint16(sum >> 48)
+	if fp == 0 {
+		fp = 1
+	}
+	return fp, sum & mask
+}
+
+// cuckooMix is murmur3 finalizer, fnv alone mix high bits poorly for similar keys
+func cuckooMix(h uint64) uint64 {
+	h ^= h >> 33
+	h *= 0xff51afd7ed558ccd
+	h ^= h >> 33
+	h *= 0xc4ceb9fe1a85ec53
+	h ^= h >> 33
+	return h
+}
+
+// cuckooAltIndex returns the other bucket of fingerprint, i == alt(alt(i))
+func cuckooAltIndex(i uint64, fp uint16, mask uint64) uint64 {
+	return (i ^ cuckooMix(uint64(fp))) & mask
+}
+
+/**************************************************************
+* struct: cuckooFilter
+**************************************************************/
+
+// cuckooFilter is in-memory cuckoo filter which supports deletion
+// fp rate is about 2*4/2^16 ≈ 0.012% per table with 16-bit fingerprint
+// when a table is full, a new one twice as large is chained after it
+type cuckooFilter struct {
+	lock   sync.Mutex
+	tables []*cuckooTable
+	rand   *rand.Rand
+	fp     *FingerprintOptions
+}
+
+// NewCuckooFilter create a cuckoo filter for about n items
+// it grows beyond capacity at cost of higher fp rate
+func NewCuckooFilter(n uint, opts ...*FingerprintOptions) Filter {
+	want := uint64(float64(n)/cuckooBucketSize/cuckooLoadFactor) + 1
+	size := uint64(1)
+	for size < want {
+		size <<= 1
+	}
+	return &cuckooFilter{
+		tables: []*cuckooTable{newCuckooTable(size)},
+		rand:   rand.New(rand.NewSource(int64(size))),
+		fp:     fingerprintOptions(opts),
+	}
+}
+
+// cuckooFilter_Seen : Caller must guarantee req is not nil
+func (self *cuckooFilter) Seen(req *Request) bool {
+	return self.SeenURL(self.fp.Fingerprint(req))
+}
+
+// cuckooFilter_SeenURL test and set raw key
+func (self *cuckooFilter) SeenURL(key string) bool {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	for _, table := range self.tables {
+		if table.lookup(key) {
+			return true
+		}
+	}
+	last := self.tables[len(self.tables)-1]
+	if !last.insert(key, self.rand) {
+		last = newCuckooTable(uint64(len(last.buckets)) * 2)
+		self.tables = append(self.tables, last)
+		last.insert(key, self.rand)
+	}
+	return false
+}
+
+// cuckooFilter_Unsee implements ForgetFilter
+func (self *cuckooFilter) Unsee(req *Request) bool {
+	return self.UnseeURL(self.fp.Fingerprint(req))
+}
+
+// cuckooFilter_UnseeURL remove raw key from filter, report whether it was there
+// false positive key removes other key with same fingerprint, see Forget
+func (self *cuckooFilter) UnseeURL(key string) bool {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	for i := len(self.tables) - 1; i >= 0; i-- {
+		if self.tables[i].remove(key, self.rand) {
+			return true
+		}
+	}
+	return false
+}
+
+// cuckooFilter_Len implements LenFilter
+func (self *cuckooFilter) Len() (n int) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	for _, table := range self.tables {
+		n += int(table.count)
+	}
+	return
+}
+
+/**************************************************************
+* struct: cuckooTable
+**************************************************************/
+
+// cuckooTable is a single fixed size table of cuckooFilter
+type cuckooTable struct {
+	buckets []cuckooBucket
+	mask    uint64
+	count   uint
+
+	// victim holds fingerprint kicked out when table is full
+	victim      uint16
+	victimIndex uint64
+}
+
+// newCuckooTable create table with size buckets, size must be power of 2
+func newCuckooTable(size uint64) *cuckooTable {
+	return &cuckooTable{buckets: make([]cuckooBucket, size), mask: size - 1}
+}
+
+// cuckooTable_index returns fingerprint and both bucket indexes of key
+func (self *cuckooTable) index(key string) (fp uint16, i1, i2 uint64) {
+	fp, i1 = cuckooHash(key, self.mask)
+	return fp, i1, cuckooAltIndex(i1, fp, self.mask)
+}
+
+// cuckooTable_lookup test fingerprint of key in both buckets and victim slot
+func (self *cuckooTable) lookup(key string) bool {
+	fp, i1, i2 := self.index(key)
+	for _, f := range self.buckets[i1] {
+		if f == fp {
+			return true
+		}
+	}
+	for _, f := range self.buckets[i2] {
+		if f == fp {
+			return true
+		}
+	}
+	return self.victim == fp && (self.victimIndex == i1 || self.victimIndex == i2)
+}
+
+// cuckooTable_insert put key into table, report false if table is already full
+func (self *cuckooTable) insert(key string, rnd *rand.Rand) bool {
+	fp, i1, i2 := self.index(key)
+	return self.insertFP(fp, i1, i2, rnd)
+}
+
+// cuckooTable_insertFP put fingerprint into table, relocating others if needed
+func (self *cuckooTable) insertFP(fp uint16, i1, i2 uint64, rnd *rand.Rand) bool {
+	if self.victim != 0 {
+		return false
+	}
+	if self.put(fp, i1) || self.put(fp, i2) {
+		self.count++
+		return true
+	}
+
+	i := i1
+	if rnd.Intn(2) == 1 {
+		i = i2
+	}
+	for n := 0; n < cuckooMaxKicks; n++ {
+		slot := rnd.Intn(cuckooBucketSize)
+		fp, self.buckets[i][slot] = self.buckets[i][slot], fp
+		i = cuckooAltIndex(i, fp, self.mask)
+		if self.put(fp, i) {
+			self.count++
+			return true
+		}
+	}
+	// table is full, keep last kicked one so nothing is lost
+	self.victim, self.victimIndex = fp, i
+	self.count++
+	return true
+}
+
+// cuckooTable_remove delete key from table, report whether it was there
+func (self *cuckooTable) remove(key string, rnd *rand.Rand) bool {
+	fp, i1, i2 := self.index(key)
+	if self.delete(fp, i1) || self.delete(fp, i2) {
+		// there is room for victim now
+		if self.victim != 0 {
+			fp, i := self.victim, self.victimIndex
+			self.victim = 0
+			self.count--
+			self.insertFP(fp, i, cuckooAltIndex(i, fp, self.mask), rnd)
+		}
+		return true
+	}
+	if self.victim == fp && (self.victimIndex == i1 || self.victimIndex == i2) {
+		self.victim = 0
+		self.count--
+		return true
+	}
+	return false
+}
+
+// cuckooTable_put put fingerprint into an empty slot of bucket i
+func (self *cuckooTable) put(fp uint16, i uint64) bool {
+	for slot, f := range self.buckets[i] {
+		if f == 0 {
+			self.buckets[i][slot] = fp
+			return true
+		}
+	}
+	return false
+}
+
+// cuckooTable_delete remove one copy of fingerprint from bucket i
+func (self *cuckooTable) delete(fp uint16, i uint64) bool {
+	for slot, f := range self.buckets[i] {
+		if f == fp {
+			self.buckets[i][slot] = 0
+			self.count--
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,76 @@
+package gospider
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestCuckooFilter(t *testing.T) {
+	n := 10000
+	filter := NewCuckooFilter(uint(n)).(*cuckooFilter)
+	for i := 0; i < n; i++ {
+		if filter.SeenURL(fmt.Sprintf("http://a.com/%d", i)) && i < 10 {
+			t.Error("you can not see what you haven't seen")
+		}
+	}
+	for i := 0; i < n; i++ {
+		if !filter.SeenURL(fmt.Sprintf("http://a.com/%d", i)) {
+			t.Fatal("cuckoo filter should not have false negative under capacity")
+		}
+	}
+
+	// forget half of them, colliding fingerprints may make a few fail
+	miss := 0
+	for i := 0; i < n; i += 2 {
+		if !filter.UnseeURL(fmt.Sprintf("http://a.com/%d", i)) {
+			miss++
+		}
+	}
+	for i := 0; i < n; i++ {
+		seen := filter.SeenURL(fmt.Sprintf("http://a.com/%d", i))
+		if i%2 == 0 && seen {
+			miss++
+		}
+	}
+	if miss > 10 {
+		t.Errorf("too many forgotten items still seen: %d", miss)
+	}
+
+	req, _ := NewGetRequest("http://b.com")
+	if ok, err := Forget(filter, req); ok || err != nil {
+		t.Error("forget unseen request should report false")
+	}
+	filter.Seen(req)
+	if ok, err := Forget(filter, req); !ok || err != nil {
+		t.Error("forget seen request should report true")
+	}
+	if _, err := Forget(NewBloomFilter(10, 0.01), req); err != ErrForgetUnsupported {
+		t.Error("plain bloom filter can not forget")
+	}
+}
+
+func TestCuckooFilterFull(t *testing.T) {
+	filter := NewCuckooFilter(8).(*cuckooFilter)
+	n := 1000
+	for i := 0; i < n; i++ {
+		if filter.SeenURL(fmt.Sprintf("http://a.com/%d", i)) && i < 10 {
+			t.Error("you can not see what you haven't seen")
+		}
+	}
+	if len(filter.tables) < 2 || filter.tables[0].victim == 0 {
+		t.Error("full filter should keep a victim and grow a new table")
+	}
+
+	// every key is recorded even after first table is full
+	for i := 0; i < n; i++ {
+		if !filter.SeenURL(fmt.Sprintf("http://a.com/%d", i)) {
+			t.Fatalf("item %d inserted after full should be seen", i)
+		}
+	}
+	if l := filter.Len(); l > n || l < n*99/100 {
+		t.Errorf("len should count items in all tables, got %d", l)
+	}
+	if !filter.UnseeURL("http://a.com/999") || filter.UnseeURL("http://a.com/999") {
+		t.Error("item in grown table should be forgotten once")
+	}
+}
@@ -0,0 +1,310 @@
+package gospider
+
+import (
+	"bufio"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"sync"
+	log "github.com/Sirupsen/logrus"
+)
+
+/**************************************************************
+* struct: diskQueue
+**************************************************************/
+
+// diskRecord is a line of request log
+// request is pushed when Request is present, otherwise acknowledged
+type diskRecord struct {
+	ID      uint64          `json:"id"`
+	Request json.RawMessage `json:"req,omitempty"`
+}
+
+// diskQueue is a priority queue persisted by append-only log under job dir
+// requests popped but not acknowledged are requeued when reopened
+type diskQueue struct {
+	*priorityQueue
+	lock sync.Mutex
+	path string
+	file *os.File
+	w    *bufio.Writer
+	// ids holds log id of requests pushed but not acknowledged yet
+	ids  map[*Request]uint64
+	data map[uint64][]byte
+	seq  uint64
+}
+
+// diskQueueFile is name of request log under job dir
+const diskQueueFile = "requests.log"
+
+// NewDiskQueue open a disk queue under dir, requests left last time are restored
+// Drain keeps remaining requests on disk, so they are restored next time
+func NewDiskQueue(dir string, capacity int) (RequestQueue, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+
+	self := &diskQueue{
+		priorityQueue: NewPriorityQueue(capacity).(*priorityQueue),
+		path:          filepath.Join(dir, diskQueueFile),
+		ids:           make(map[*Request]uint64),
+		data:          make(map[uint64][]byte),
+	}
+
+	if err := self.replay(); err != nil {
+		return nil, err
+	}
+	if err := self.compact(); err != nil {
+		return nil, err
+	}
+	log.Infof("[INIT] disk queue %s restored %d requests", self.path, len(self.ids))
+	return self, nil
+}
+
+// diskQueue_replay will restore requests from log
+func (self *diskQueue) replay() error {
+	f, err := os.Open(self.path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 64*1024*1024)
+	for scanner.Scan() {
+		var rec diskRecord
+		if err := json.Unmarshal(scanner.Bytes(), &rec); err != nil {
+			// last line may be broken by crash
+			log.Warnf("[INIT] disk queue skip broken record: %s", err)
+			continue
+		}
+		if rec.ID > self.seq {
+			self.seq = rec.ID
+		}
+		if rec.Request != nil {
+			self.data[rec.ID] = rec.Request
+		} else {
+			delete(self.data, rec.ID)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+
+	for id, data := range self.data {
+		req, err := UnmarshalRequest(data)
+		if err != nil {
+			log.Warnf("[INIT] disk queue skip broken request: %s", err)
+			delete(self.data, id)
+			continue
+		}
+		self.ids[req] = id
+		self.priorityQueue.restore(req, id)
+	}
+	return nil
+}
+
+// diskQueue_compact rewrite log with alive requests only and reopen it
+func (self *diskQueue) compact() error {
+	if self.file != nil {
+		self.w.Flush()
+		self.file.Close()
+		self.file = nil
+	}
+
+	tmp := self.path + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(f)
+	for id, data := range self.data {
+		if err = writeRecord(w, diskRecord{id, data}); err != nil {
+			f.Close()
+			return err
+		}
+	}
+	if err = w.Flush(); err == nil {
+		err = f.Sync()
+	}
+	f.Close()
+	if err != nil {
+		return err
+	}
+	if err = os.Rename(tmp, self.path); err != nil {
+		return err
+	}
+
+	if self.file, err = os.OpenFile(self.path, os.O_WRONLY|os.O_APPEND, 0644); err != nil {
+		return err
+	}
+	self.w = bufio.NewWriter(self.file)
+	return nil
+}
+
+// writeRecord append a json line
+func writeRecord(w *bufio.Writer, rec diskRecord) error {
+	buf, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+	if _, err = w.Write(buf); err != nil {
+		return err
+	}
+	return w.WriteByte('\n')
+}
+
+// diskQueue_log append a record and flush it
+func (self *diskQueue) log(rec diskRecord) {
+	if self.file == nil {
+		return
+	}
+	err := writeRecord(self.w, rec)
+	if err == nil {
+		err = self.w.Flush()
+	}
+	if err != nil {
+		log.Errorf("[DISK] write request log failed: %s", err)
+	}
+}
+
+// diskQueue_Push will persist request before push it to memory
+func (self *diskQueue) Push(req *Request) bool {
+	data, err := req.Marshal()
+	if err != nil {
+		log.Errorf("[DISK] marshal %s failed: %s", req.Repr(), err)
+		return self.priorityQueue.Push(req)
+	}
+
+	self.lock.Lock()
+	self.seq++
+	id := self.seq
+	self.ids[req] = id
+	self.data[id] = data
+	self.log(diskRecord{id, data})
+	self.lock.Unlock()
+
+	if !self.priorityQueue.Push(req) {
+		// not accepted, cancel it
+		self.Ack(req)
+		return false
+	}
+	return true
+}
+
+// diskQueue_Ack will remove request from disk
+func (self *diskQueue) Ack(req *Request) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	if id, ok := self.ids[req]; ok {
+		delete(self.ids, req)
+		delete(self.data, id)
+		self.log(diskRecord{ID: id})
+	}
+}
+
+// diskQueue_Drain returns requests in memory while keeping all of them on disk
+// log is compacted and closed after that
+func (self *diskQueue) Drain() []*Request {
+	reqs := self.priorityQueue.Drain()
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	if err := self.compact(); err != nil {
+		log.Errorf("[DISK] compact request log failed: %s", err)
+	}
+	if self.file != nil {
+		self.file.Close()
+		self.file = nil
+	}
+	return reqs
+}
+
+/**************************************************************
+* struct: diskFilter
+**************************************************************/
+
+// diskFilter is map filter persisted by append-only log of seen keys
+type diskFilter struct {
+	lock sync.Mutex
+	seen map[string]struct{}
+	file *os.File
+	w    *bufio.Writer
+	fp   *FingerprintOptions
+}
+
+// diskFilterFile is name of seen log under job dir
+const diskFilterFile = "seen.log"
+
+// NewDiskFilter open a dupe filter under dir, keys seen last time are restored
+// options must not change between runs, otherwise restored keys never match
+func NewDiskFilter(dir string, opts ...*FingerprintOptions) (Filter, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	path := filepath.Join(dir, diskFilterFile)
+
+	self := &diskFilter{seen: make(map[string]struct{}), fp: fingerprintOptions(opts)}
+	if f, err := os.Open(path); err == nil {
+		scanner := bufio.NewScanner(f)
+		scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+		for scanner.Scan() {
+			self.seen[scanner.Text()] = struct{}{}
+		}
+		f.Close()
+		if err = scanner.Err(); err != nil {
+			return nil, err
+		}
+	} else if !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+	self.file = file
+	self.w = bufio.NewWriter(file)
+	return self, nil
+}
+
+// diskFilter_Seen : Caller must guarantee req is not nil
+func (self *diskFilter) Seen(req *Request) bool {
+	key := self.fp.Fingerprint(req)
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	if _, ok := self.seen[key]; ok {
+		return true
+	}
+	self.seen[key] = struct{}{}
+	if self.file == nil {
+		return false
+	}
+	self.w.WriteString(key)
+	self.w.WriteByte('\n')
+	if err := self.w.Flush(); err != nil {
+		log.Errorf("[DISK] write seen log failed: %s", err)
+	}
+	return false
+}
+
+// diskFilter_Close flush seen log to disk and close it
+// filter still works in memory after that, while new keys are not persisted
+func (self *diskFilter) Close() error {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	if self.file == nil {
+		return nil
+	}
+	err := self.w.Flush()
+	if err == nil {
+		err = self.file.Sync()
+	}
+	if e := self.file.Close(); err == nil {
+		err = e
+	}
+	self.file = nil
+	return err
+}
@@ -0,0 +1,72 @@
+package gospider
+
+import (
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestDiskQueue(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gospider")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	q, err := NewDiskQueue(dir, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, u := range []string{"http://a.com/0", "http://a.com/1", "http://a.com/2"} {
+		req, _ := NewRequest("POST", u, strings.NewReader("body"), MetaMap{"depth": 1})
+		q.Push(req.SetCallback("cb").SetPriority(1))
+	}
+
+	// first is acknowledged, second is popped but not acknowledged
+	q.(AckQueue).Ack(q.Pop())
+	q.Pop()
+	q.Close()
+	if left := q.Drain(); len(left) != 1 {
+		t.Errorf("expect 1 request left in memory, got %d", len(left))
+	}
+
+	// reopen: unacknowledged and remaining requests are restored in order
+	q, err = NewDiskQueue(dir, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if q.Len() != 2 {
+		t.Fatalf("expect 2 requests restored, got %d", q.Len())
+	}
+	req := q.Pop()
+	if req.URL.String() != "http://a.com/1" || req.Method != "POST" || req.Callback != "cb" || req.Priority != 1 {
+		t.Errorf("request should be restored as it is: %+v", req)
+	}
+	if depth, _ := req.Meta.GetInt("depth"); depth != 1 {
+		t.Error("request meta should be restored")
+	}
+	if body, _ := ioutil.ReadAll(req.Body); string(body) != "body" {
+		t.Error("request body should be restored")
+	}
+}
+
+func TestDiskFilter(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gospider")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	filter, _ := NewDiskFilter(dir)
+	reqA, _ := NewGetRequest("http://a.com")
+	if filter.Seen(reqA) || !filter.Seen(reqA) {
+		t.Error("disk filter should work as map filter")
+	}
+
+	filter, _ = NewDiskFilter(dir)
+	reqA, _ = NewGetRequest("http://a.com")
+	if !filter.Seen(reqA) {
+		t.Error("seen state should survive reopen")
+	}
+}
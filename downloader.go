@@ -1,47 +1,206 @@
 package gospider
 
-import "net/http"
-
+import (
+	"context"
+	"net/http"
+	"sync"
+)
 
 /**************************************************************
 * interface: Downloader
 **************************************************************/
 // Downloader is interface of downloader module
+// response may come along with error (e.g. rejected by middleware), so that
+// its status is known. caller should close its body in that case
 type Downloader interface {
 	Download(req *Request) (*Response, error)
 }
 
+// ContextDownloader is downloader that could be cancelled by context
+type ContextDownloader interface {
+	Downloader
+	DownloadContext(ctx context.Context, req *Request) (*Response, error)
+}
+
+// DownloadContext adapts any Downloader to context-carrying version
+// if d is not a ContextDownloader, request is downloaded with ctx attached
+// and ctx.Err() is returned as soon as ctx is done. response arrives after
+// that is discarded with its body closed
+func DownloadContext(ctx context.Context, d Downloader, req *Request) (*Response, error) {
+	if cd, ok := d.(ContextDownloader); ok {
+		return cd.DownloadContext(ctx, req)
+	}
+	origin := req
+	if req != nil && req.Request != nil {
+		r := *req
+		r.Request = req.Request.WithContext(ctx)
+		req = &r
+	}
+
+	type result struct {
+		res *Response
+		err error
+	}
+	// abandoned is set when ctx is done, worker never blocks on sending
+	var lock sync.Mutex
+	abandoned := false
+	c := make(chan result, 1)
+	go func() {
+		res, err := d.Download(req)
+		if res != nil && res.Request == req {
+			// response should refer to origin request
+			res.Request = origin
+		}
+		lock.Lock()
+		defer lock.Unlock()
+		if abandoned {
+			closeResponse(res)
+			return
+		}
+		c <- result{res, err}
+	}()
+
+	select {
+	case r := <-c:
+		return r.res, r.err
+	case <-ctx.Done():
+		lock.Lock()
+		abandoned = true
+		lock.Unlock()
+		// result sent just before abandoned is discarded too
+		select {
+		case r := <-c:
+			closeResponse(r.res)
+		default:
+		}
+		return nil, ctx.Err()
+	}
+}
+
 /**************************************************************
 * struct: myDownloader
 **************************************************************/
 // myDownloader is default implement of interface Downloader
+// request with Meta[KeyProxy] is sent through that proxy
+// request with Meta[KeySession] keeps cookies in that session
+// gzip, deflate and br response bodies are decoded transparently
 type myDownloader struct {
 	*http.Client
+
+	// proxies caches client of each proxy url
+	proxies sync.Map
+
+	// sessions holds cookie jars shared by all requests of downloader
+	sessions *CookieSessions
 }
 
-// NewDownloader will create a new downloader from given id
-func NewDownloader(client *http.Client) (Downloader, error) {
+// NewDownloader will create a new downloader from given client
+// middlewares are applied in given order, see DownloaderMiddleware
+func NewDownloader(client *http.Client, middlewares ...DownloaderMiddleware) (Downloader, error) {
 	if client == nil {
 		client = new(http.Client)
 	}
 
-	return &myDownloader{
-		Client: client,
-	}, nil
+	for _, m := range middlewares {
+		if m == nil {
+			return nil, ErrNilMiddleware
+		}
+	}
+
+	return NewDownloaderChain(&myDownloader{
+		Client:   client,
+		sessions: NewCookieSessions(),
+	}, middlewares...), nil
 }
 
 // myDownloader_Download will download response from given request
 func (self *myDownloader) Download(req *Request) (res *Response, err error) {
-	if req == nil && req.URL == nil {
+	return self.DownloadContext(context.Background(), req)
+}
+
+// myDownloader_DownloadContext will abort http request when ctx is done
+func (self *myDownloader) DownloadContext(ctx context.Context, req *Request) (res *Response, err error) {
+	if req == nil || req.Request == nil {
 		return nil, ErrNilRequest
 	}
 
-	httpRes, err := self.Do(req.Request)
+	client := self.Client
+	if proxy, ok := req.Meta[KeyProxy].(string); ok && proxy != "" {
+		if client, err = self.proxyClient(proxy); err != nil {
+			return nil, err
+		}
+	}
+
+	// jar of client is used for default session if there is one
+	session, named := req.Meta[KeySession].(string)
+	if named || client.Jar == nil {
+		c := *client
+		c.Jar = self.sessions.Jar(session)
+		client = &c
+	}
+
+	httpReq := req.Request.WithContext(ctx)
+	if httpReq.Header.Get("Accept-Encoding") == "" {
+		httpReq.Header = httpReq.Header.Clone()
+		if httpReq.Header == nil {
+			httpReq.Header = make(http.Header, 1)
+		}
+		httpReq.Header.Set("Accept-Encoding", acceptEncoding)
+	}
+
+	httpRes, err := client.Do(httpReq)
 	if err != nil {
 		return NewResponse(httpRes, req), err
-	} else {
-		return NewResponse(httpRes, req), nil
 	}
+	if err = decodeContent(httpRes); err != nil {
+		return NewResponse(httpRes, req), err
+	}
+	return NewResponse(httpRes, req), nil
+}
+
+// myDownloader_Sessions returns cookie sessions of downloader
+func (self *myDownloader) Sessions() *CookieSessions {
+	return self.sessions
+}
+
+// SessionsOf returns cookie sessions of downloader, nil if it does not keep cookies
+func SessionsOf(d Downloader) *CookieSessions {
+	if c, ok := d.(*chainDownloader); ok {
+		d = c.Downloader
+	}
+	if sd, ok := d.(interface{ Sessions() *CookieSessions }); ok {
+		return sd.Sessions()
+	}
+	return nil
+}
+
+// myDownloader_proxyClient returns client that sends requests through proxy
+// http, https (CONNECT for https targets) and socks5 proxies are supported
+func (self *myDownloader) proxyClient(proxy string) (*http.Client, error) {
+	if c, ok := self.proxies.Load(proxy); ok {
+		return c.(*http.Client), nil
+	}
+
+	u, err := parseProxyURL(proxy)
+	if err != nil {
+		return nil, err
+	}
+
+	base := self.Transport
+	if base == nil {
+		base = http.DefaultTransport
+	}
+	t, ok := base.(*http.Transport)
+	if !ok {
+		return nil, ErrProxyUnsupported
+	}
+	t = t.Clone()
+	t.Proxy = http.ProxyURL(u)
+
+	client := *self.Client
+	client.Transport = t
+	c, _ := self.proxies.LoadOrStore(proxy, &client)
+	return c.(*http.Client), nil
 }
 
 // ParallelWork start a series number of worker
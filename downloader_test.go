@@ -1,6 +1,10 @@
 package gospider
 
-import "testing"
+import (
+	"context"
+	"testing"
+	"time"
+)
 
 func TestNewDownloader(t *testing.T) {
 	downloader, err := NewDownloader(nil)
@@ -30,3 +34,45 @@ func TestNewDownloader(t *testing.T) {
 		}
 	}
 }
+
+// closeCheckBody records whether it is closed
+type closeCheckBody struct {
+	fakeBody
+	closed Counter
+}
+
+func (self *closeCheckBody) Close() error {
+	self.closed.Set(1)
+	return nil
+}
+
+// lateDownloader returns response once released, regardless of request context
+type lateDownloader struct {
+	release chan struct{}
+	body    *closeCheckBody
+}
+
+func (self *lateDownloader) Download(req *Request) (*Response, error) {
+	<-self.release
+	res := FakeResponse(req.URL.String(), "")
+	res.Response.Body = self.body
+	return res, nil
+}
+
+func TestDownloadContext(t *testing.T) {
+	d := &lateDownloader{release: make(chan struct{}), body: &closeCheckBody{FakeBody("late"), NewCounter()}}
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(10*time.Millisecond, cancel)
+
+	req, _ := NewGetRequest("http://a.com/")
+	if _, err := DownloadContext(ctx, d, req); err != context.Canceled {
+		t.Errorf("download should be cancelled, got %v", err)
+	}
+	close(d.release)
+	for i := 0; i < 100 && d.body.closed.Get() == 0; i++ {
+		time.Sleep(time.Millisecond)
+	}
+	if d.body.closed.Get() == 0 {
+		t.Error("body of response arrives after cancel should be closed")
+	}
+}
@@ -1,6 +1,14 @@
 package gospider
 
-import log "github.com/Sirupsen/logrus"
+import (
+	"context"
+	"errors"
+	"io"
+	"os"
+	"sync"
+	"time"
+	log "github.com/Sirupsen/logrus"
+)
 
 /**************************************************************
 * struct:  EngineArgs
@@ -26,7 +34,8 @@ type EngineArgs struct {
 	// downloader work count. should not be zero
 	DWorkers uint32
 
-	// ReqBufSize sets request chan buffer size. set to a small number is ok
+	// ReqBufSize sets request queue capacity. zero is treated as 1
+	// requests with higher priority are downloaded first within the queue
 	ReqBufSize uint32
 
 	// ResBufSize is response chan buffer size. set to zero to be on-demand-spawn
@@ -37,6 +46,31 @@ type EngineArgs struct {
 
 	// ErrBufSize could be set to a proper number like 1000
 	ErrBufSize uint32
+
+	// HostPolicy limits concurrency & delay toward each host. zero means no limit
+	HostPolicy HostPolicy
+
+	// HostPolicies overrides HostPolicy for specific hosts (e.g. "www.example.com:8080")
+	HostPolicies map[string]HostPolicy
+
+	// AutoThrottle adjusts host delay & concurrency dynamically. nil to disable
+	AutoThrottle *AutoThrottle
+
+	// Retry decides how failed downloads are retried. nil to disable
+	Retry *RetryPolicy
+
+	// Queue is request frontier. nil to use in-memory priority queue of ReqBufSize
+	// use NewDiskQueue with NewDiskFilter to make crawl resumable
+	// with host limits, queue not being a SelectiveQueue is wrapped to prefetch
+	// a few requests, so that requests of busy hosts do not block others
+	Queue RequestQueue
+
+	// FilterSnapshot is file that filter is restored from on start and saved to on stop
+	// filter must be a PersistentFilter, otherwise it is ignored. empty to disable
+	FilterSnapshot string
+
+	// FilterSnapshotInterval saves filter periodically while running. zero to disable
+	FilterSnapshotInterval time.Duration
 }
 
 // Default presets
@@ -58,7 +92,17 @@ func NewEngineArgs() *EngineArgs {
 
 type Engine interface {
 	Scheduler
+	// Run start engine with given generator and return error chan
+	// error chan will be closed when engine stopped
 	Run(<-chan Data) <-chan error
+	// RunContext is like Run, while engine is stopped when ctx is done
+	// outstanding downloads, parsers & pipelines are cancelled too
+	RunContext(context.Context, <-chan Data) <-chan error
+	// Stop will stop engine gracefully and return undelivered data
+	Stop() []Data
+	// Stats returns a snapshot of engine statistics
+	Stats() Stats
+	// Summary gives human readable statistics
 	Summary() string
 }
 
@@ -69,45 +113,201 @@ type myEngine struct {
 	Analyzer   Analyzer
 	Downloader Downloader
 	Pipeline   Pipeline
+
+	// workers tracks long running loops, tasks tracks on-demand-spawn goroutines
+	workers  sync.WaitGroup
+	tasks    sync.WaitGroup
+	stopOnce sync.Once
+
+	// exhausted is set to 1 when generator is closed
+	exhausted Counter
+
+	// ctx is root context of all work, cancel is called after stopped
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	// limiter keeps politeness toward each host. nil means no limit
+	limiter *hostLimiter
+
+	// snapshotPath is Args.FilterSnapshot if filter could be saved, otherwise empty
+	snapshotPath string
 }
 
 func NewEngine(args *EngineArgs) Engine {
+	queue := args.Queue
+	if queue == nil {
+		queue = NewPriorityQueue(int(args.ReqBufSize))
+	}
+
 	engine := &myEngine{
 		myScheduler: myScheduler{
 			Filter:    args.Filter,
-			Requests:  make(chan *Request, args.ReqBufSize),
+			Requests:  queue,
 			Responses: make(chan *Response, args.ResBufSize),
 			Items:     make(chan Item, args.ItemBufSize),
 			Errors:    make(chan error, args.ErrBufSize),
+			quit:      make(chan struct{}),
+			inflight:  NewCounter(),
+			stats:     newStats(),
 		},
+		Name:       args.Name,
+		exhausted:  NewCounter(),
 		Args:       args,
 		Analyzer:   args.Analyzer,
 		Downloader: args.Downloader,
 		Pipeline:   args.Pipeline,
 	}
+
+	engine.limiter = newHostLimiter(args.HostPolicy, args.HostPolicies, args.AutoThrottle, hostDelayers(args.Downloader), nil)
+	if engine.limiter != nil {
+		// worker never waits for a busy host, requests of other hosts go first
+		q, ok := engine.Requests.(SelectiveQueue)
+		if !ok {
+			q = newPrefetchQueue(engine.Requests, queuePrefetch)
+			engine.Requests = q
+		}
+		engine.limiter.wake = q.Wake
+	}
+	if args.FilterSnapshot != "" {
+		if _, ok := args.Filter.(PersistentFilter); ok {
+			engine.snapshotPath = args.FilterSnapshot
+		} else {
+			log.Errorf("[INIT] filter snapshot disabled: %s", ErrPersistUnsupported)
+		}
+	}
 	return engine
 }
 
 func (self *myEngine) Run(generator <-chan Data) <-chan error {
+	return self.RunContext(context.Background(), generator)
+}
+
+func (self *myEngine) RunContext(ctx context.Context, generator <-chan Data) <-chan error {
 	log.Info("[INIT] engine starting...")
+	self.ctx, self.cancel = context.WithCancel(ctx)
+	// elapsed time & rates exclude setup time before run
+	self.stats.restart()
+	self.loadSnapshot()
+	// requests restored by queue are in flight too
+	if _, ok := self.Requests.(SharedQueue); !ok {
+		self.inflight.Add(int64(self.Requests.Len()))
+	}
+	go func() {
+		select {
+		case <-self.ctx.Done():
+			if pending := self.Stop(); len(pending) > 0 {
+				log.Warnf("[STOP] context done, %d pending data discarded", len(pending))
+			}
+		case <-self.quit:
+		}
+	}()
+
 	self.analyze()
 	self.pipeline()
 	self.download()
+	self.snapshot()
 
+	// engine stops itself when generator is closed and all work is done
+	// with nil generator, engine runs until Stop is called
 	if generator != nil {
-		self.Pull(generator)
+		self.spawn(&self.workers, func() {
+			self.pull(generator)
+			self.exhausted.Set(1)
+			self.checkDone()
+		})
 	}
 
 	return (<-chan error)(self.Errors)
 }
 
-func (self *myEngine) Stop([]Data) error {
-	log.Info("[INIT] engine stopping...[Not implemented]")
-	return nil
+// myEngine_Stop will stop pulling from generator, wait all working goroutines
+// finish, then return undelivered requests, responses & items. Error chan
+// returned by Run is closed after that. Only first call takes effect.
+func (self *myEngine) Stop() (pending []Data) {
+	self.stopOnce.Do(func() {
+		log.Info("[STOP] engine stopping...")
+		self.shutdown()
+		self.workers.Wait()
+		self.tasks.Wait()
+		self.saveSnapshot()
+		if c, ok := self.Filter.(io.Closer); ok {
+			if err := c.Close(); err != nil {
+				log.Errorf("[STOP] close filter failed: %s", err)
+			}
+		}
+		pending = self.drain()
+		if self.cancel != nil {
+			self.cancel()
+		}
+		close(self.Errors)
+		log.Infof("[STOP] engine stopped with %d pending data", len(pending))
+		log.Infof("[STOP] %s", self.Summary())
+	})
+	return
+}
+
+// myEngine_Idle tells whether there is no work in flight
+// unlike myScheduler_Idle, work held by goroutines is also counted
+func (self *myEngine) Idle() bool {
+	return self.inflight.Get() == 0
+}
+
+// myEngine_finish mark a piece of data (request/response/item) handled
+// data yield during handling must be sent before calling finish
+func (self *myEngine) finish() {
+	if self.inflight.Dec() == 0 {
+		self.checkDone()
+	}
+}
+
+// myEngine_checkDone will stop engine when generator is exhausted and engine is idle
+// engine with shared queue keeps running until Stop is called
+func (self *myEngine) checkDone() {
+	if _, ok := self.Requests.(SharedQueue); ok {
+		return
+	}
+	if self.exhausted.Get() == 1 && self.Idle() {
+		log.Info("[STOP] generator exhausted and all work done")
+		go self.Stop()
+	}
+}
+
+// myEngine_Stats returns current statistics of each stage
+func (self *myEngine) Stats() Stats {
+	stats := self.stats.Snapshot()
+	stats.Name = self.Name
+	stats.Inflight = self.inflight.Get()
+	if f, ok := self.Filter.(StatsFilter); ok {
+		fs := f.Stats()
+		stats.Filter = &fs
+	} else if f, ok := self.Filter.(LenFilter); ok {
+		stats.Filter = &FilterStats{Len: f.Len()}
+	}
+	return stats
 }
 
 func (self *myEngine) Summary() string {
-	return "not implemented"
+	return self.Stats().String()
+}
+
+// myEngine_spawn run f in a new goroutine tracked by wg
+func (self *myEngine) spawn(wg *sync.WaitGroup, f func()) {
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		f()
+	}()
+}
+
+// myEngine_async run f in a task goroutine, which counts as in flight
+// download worker use it to schedule requests, since pushing to full queue
+// blocks until a worker pops, and the caller may be the only one
+func (self *myEngine) async(f func()) {
+	self.inflight.Inc()
+	self.spawn(&self.tasks, func() {
+		defer self.finish()
+		f()
+	})
 }
 
 func (self *myEngine) download() {
@@ -115,62 +315,247 @@ func (self *myEngine) download() {
 	if n = self.Args.DWorkers; n == 0 {
 		// means on-demand-spawn goroutines // dangerous
 		log.Infof("[INIT] DWorker = 0. spawn goroutine for each request.")
-		for req := range self.Requests {
-			go self.downloadReq(req)
-		}
-
+		self.spawn(&self.workers, func() {
+			for req := self.nextRequest(); req != nil; req = self.nextRequest() {
+				req := req
+				self.spawn(&self.tasks, func() { self.downloadReq(req) })
+			}
+		})
 	} else {
 		log.Infof("[INIT] DWorker = %d. spawn %d download goroutine", n, n)
-		ParallelWork(n, self.downloadLoop)
+		for i := uint32(1); i <= n; i++ {
+			id := int(i)
+			self.spawn(&self.workers, func() { self.downloadLoop(id) })
+		}
 	}
 	log.Infof("[INIT] Downloader init complete")
 }
 
 func (self *myEngine) downloadLoop(id int) {
 	log.Infof("[INIT] Downloader[id:%d] routine init", id)
-	for req := range self.Requests {
+	// nextRequest returns nil when scheduler is shutdown
+	for req := self.nextRequest(); req != nil; req = self.nextRequest() {
 		log.Debugf("[DOWN]-[%d] fetch %s ", id, req.URL)
-		res, err := self.Downloader.Download(req)
-		if err != nil {
-			self.Errors <- err
-		} else {
-			self.Responses <- res
-			log.Infof("[DOWN][%d] done %s ", id, req.URL)
-		}
+		self.downloadReq(req)
 	}
+	log.Infof("[STOP] Downloader[id:%d] routine exit", id)
 }
 
-// myEngine_downloadReq : on-demand-spawn
+// myEngine_downloadReq will download one request and put response
 func (self *myEngine) downloadReq(req *Request) {
-
+	defer self.finish()
 	log.Infof("[DOWN] %s begin", req.URL)
-	res, err := self.Downloader.Download(req)
+	res, err := self.fetch(req)
+	if err != nil && self.ctx.Err() != nil {
+		// aborted request is stashed without ack
+		self.Errors <- NewCrawlError(StageDownload, req, err)
+		return
+	}
+	if rs, ok := err.(*Reschedule); ok {
+		self.async(func() { self.requeue(req, rs.Request) })
+		return
+	}
+	// retried request is acknowledged when it is rescheduled
+	if self.retry(req, res, err) {
+		return
+	}
 	if err != nil {
-		self.Errors <- err
+		self.async(func() {
+			self.errback(req, res, err)
+			self.ack(req)
+		})
+		return
 	}
-	// Put Response
-	self.Responses <- res
+	if self.retryExhausted(res) {
+		// final response is still analyzed, while failure is reported
+		self.Errors <- downloadError(req, res, ErrRetryExhausted)
+	}
+	// request is acknowledged after response analyzed and its output sent
+	res.ack = req
+	self.PutResponse(res)
 	log.Infof("[DOWN] %s complete", req.URL)
 }
 
+// myEngine_retry will reschedule failed request after backoff
+// return false if request should not or can not be retried anymore
+func (self *myEngine) retry(req *Request, res *Response, err error) bool {
+	policy := self.Args.Retry
+	if policy == nil || self.ctx.Err() != nil || !policy.ShouldRetry(res, err) {
+		return false
+	}
+
+	n := req.RetryTimes()
+	if n >= policy.MaxRetries || !self.retryBudget() {
+		return false
+	}
+
+	delay := policy.Backoff(n+1, res)
+	closeResponse(res)
+	if req.Meta == nil {
+		req.Meta = make(MetaMap, 1)
+	}
+	req.Meta[KeyRetryTimes] = n + 1
+	req.DisableFilter()
+	self.stats.retried.Inc()
+	log.Infof("[DOWN] retry %s (%d) in %s", req.URL, n+1, delay)
+
+	// retry waiting is still in flight
+	self.inflight.Inc()
+	self.spawn(&self.tasks, func() {
+		defer self.finish()
+		select {
+		case <-time.After(delay):
+			self.requeue(req, req)
+		case <-self.quit:
+			self.stash(req)
+		}
+	})
+	return true
+}
+
+// myEngine_errback will hand failed request to its errback if any
+// data yield by errback are scheduled, otherwise error is reported with request
+// res is response along with error, could be nil
+func (self *myEngine) errback(req *Request, res *Response, err error) {
+	if errors.Is(err, ErrDropRequest) {
+		self.Errors <- downloadError(req, res, err)
+		return
+	}
+
+	if ea, ok := self.Analyzer.(ErrbackAnalyzer); ok && req.Errback != "" {
+		data, e := ea.HandleError(req, err)
+		if e != ErrCallbackNotFount {
+			self.SendDataList(data)
+			if e != nil {
+				self.Errors <- NewCrawlError(StageAnalyze, req, e)
+			}
+			return
+		}
+		log.Warnf("[DOWN] errback %s of %s not found", req.Errback, req.URL)
+	}
+	self.Errors <- downloadError(req, res, err)
+}
+
+// downloadError wraps err of download stage with status of response if there is one
+func downloadError(req *Request, res *Response, err error) *CrawlError {
+	e := NewCrawlError(StageDownload, req, err)
+	if res != nil && res.Response != nil {
+		e.StatusCode = res.StatusCode
+	}
+	return e
+}
+
+// myEngine_ack acknowledge request handled if queue requires
+func (self *myEngine) ack(req *Request) {
+	if q, ok := self.Requests.(AckQueue); ok {
+		q.Ack(req)
+	}
+}
+
+// myEngine_requeue schedule next in place of req, then acknowledge req
+// so that a crash in between never lose it. next could be req itself,
+// which is copied since queue tracks acknowledgement by request
+func (self *myEngine) requeue(req, next *Request) {
+	if next == req {
+		r := *req
+		next = &r
+	}
+	self.PutRequest(next)
+	self.ack(req)
+}
+
+// myEngine_retryBudget tells whether retry budget is not run out
+func (self *myEngine) retryBudget() bool {
+	policy := self.Args.Retry
+	if policy.Budget <= 0 {
+		return true
+	}
+	attempts := self.stats.downloaded.Get() + self.stats.failed.Get()
+	return self.stats.retried.Get() < int64(policy.Budget*float64(attempts))+int64(policy.MaxRetries)
+}
+
+// myEngine_retryExhausted tells whether response should be retried but can not anymore
+func (self *myEngine) retryExhausted(res *Response) bool {
+	policy := self.Args.Retry
+	return policy != nil && self.ctx.Err() == nil && policy.ShouldRetry(res, nil)
+}
+
+// myEngine_nextRequest will get a request whose host slot is free
+// queue is always selective when there is a limiter, see NewEngine
+// return nil when scheduler is shutdown
+func (self *myEngine) nextRequest() *Request {
+	if self.limiter == nil {
+		return self.GetRequest()
+	}
+	return self.Requests.(SelectiveQueue).PopFunc(self.limiter.TryAcquire)
+}
+
+// myEngine_fetch download request and record download statistics
+// request aborted by context is stashed as pending data
+// on failure, response (if any) is returned with body closed
+func (self *myEngine) fetch(req *Request) (*Response, error) {
+	start := time.Now()
+	res, err := DownloadContext(self.ctx, self.Downloader, req)
+	if self.limiter != nil {
+		self.limiter.Release(req, time.Since(start), res)
+	}
+	if err == nil && res != nil && res.Response != nil && res.Response.Body != nil {
+		res.Response.Body = &countBody{res.Response.Body, self.stats.bytes}
+		// buffer body so that parsers could read it many times, streamed body stays on disk
+		if res.BodyFile == "" {
+			_, err = res.Body()
+		}
+	}
+	if err != nil {
+		// response along with error is kept for its status only
+		closeResponse(res)
+	}
+	if err != nil && self.ctx.Err() != nil {
+		self.stash(req)
+		return nil, err
+	}
+	if _, ok := err.(*Reschedule); ok {
+		return nil, err
+	}
+	if err != nil {
+		self.stats.failed.Inc()
+		return res, err
+	}
+	self.stats.downloaded.Inc()
+	return res, nil
+}
+
 // analyze start an analyze loop (ODS: on demand spawn)
 func (self *myEngine) analyze() {
 	log.Infof("[INIT] Analyzer init begin")
-	go func() {
-		for res := range self.Responses {
-			if res == nil {
-				self.Errors <- ErrNilResponse
-			} else {
-				go self.parseOne(res)
+	self.spawn(&self.workers, func() {
+		for {
+			select {
+			case res := <-self.Responses:
+				if res == nil {
+					self.Errors <- NewCrawlError(StageAnalyze, nil, ErrNilResponse)
+				} else {
+					self.spawn(&self.tasks, func() { self.parseOne(res) })
+				}
+			case <-self.quit:
+				return
 			}
 		}
-	}()
+	})
 	log.Infof("[INIT] Analyzer init complete")
 }
 
 func (self *myEngine) parseOne(res *Response) {
+	defer self.finish()
 	log.Info("[ANAY] parser one item")
-	data, err := self.Analyzer.Analyze(res)
+	data, err := AnalyzeContext(self.ctx, self.Analyzer, res)
+	if err != nil && self.ctx.Err() != nil {
+		// parse aborted by context, keep response as pending
+		self.stash(res)
+		return
+	}
+	self.stats.parsed.Inc()
+	closeResponse(res)
 	if len(data) > 0 {
 		self.SendDataList(data)
 	} else {
@@ -178,30 +563,103 @@ func (self *myEngine) parseOne(res *Response) {
 	}
 
 	if err != nil {
-		self.Errors <- err
+		e := NewCrawlError(StageAnalyze, res.Request, err)
+		if res.Response != nil {
+			e.StatusCode = res.StatusCode
+		}
+		self.Errors <- e
+	}
+	if res.ack != nil {
+		self.ack(res.ack)
 	}
 }
 
 func (self *myEngine) pipeline() {
 	log.Infof("[INIT] Pipeline init begin")
-	go func() {
-		for item := range self.Items {
-			if item == nil {
-				self.Errors <- ErrNilItem
-			} else {
-				go self.pickOne(item)
+	self.spawn(&self.workers, func() {
+		for {
+			select {
+			case item := <-self.Items:
+				if item == nil {
+					self.Errors <- NewCrawlError(StagePipeline, nil, ErrNilItem)
+				} else {
+					self.spawn(&self.tasks, func() { self.pickOne(item) })
+				}
+			case <-self.quit:
+				return
 			}
 		}
-	}()
+	})
 	log.Infof("[INIT] Pipeline init complete")
 }
 
 func (self *myEngine) pickOne(item Item) {
+	defer self.finish()
 	log.Info("[PIPE] pick item")
-	errs := self.Pipeline.Send(item)
+	if self.ctx.Err() != nil {
+		self.stash(item)
+		return
+	}
+	errs := SendContext(self.ctx, self.Pipeline, item)
 	if len(errs) > 0 {
 		for _, err := range errs {
-			self.Errors <- err
+			if errors.Is(err, ErrDropItem) {
+				self.stats.dropped.Inc()
+			}
+			e := NewCrawlError(StagePipeline, nil, err)
+			e.Item = item
+			self.Errors <- e
+		}
+	}
+}
+
+/**************************************************************
+* filter snapshot
+**************************************************************/
+
+// myEngine_loadSnapshot restore filter from snapshot file if there is one
+func (self *myEngine) loadSnapshot() {
+	path := self.snapshotPath
+	if path == "" {
+		return
+	}
+	if err := LoadFilter(self.Filter, path); err != nil {
+		if !os.IsNotExist(err) {
+			log.Errorf("[INIT] load filter snapshot %s failed: %s", path, err.Error())
+		}
+		return
+	}
+	log.Infof("[INIT] filter restored from %s", path)
+}
+
+// myEngine_snapshot save filter periodically until engine quit
+func (self *myEngine) snapshot() {
+	interval := self.Args.FilterSnapshotInterval
+	if self.snapshotPath == "" || interval <= 0 {
+		return
+	}
+	self.spawn(&self.workers, func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-self.quit:
+				return
+			case <-ticker.C:
+				self.saveSnapshot()
+			}
 		}
+	})
+}
+
+// myEngine_saveSnapshot write filter to snapshot file, errors are reported
+// nothing is done if filter is not a PersistentFilter, NewEngine logs that once
+func (self *myEngine) saveSnapshot() {
+	path := self.snapshotPath
+	if path == "" {
+		return
+	}
+	if err := SaveFilter(self.Filter, path); err != nil {
+		self.Errors <- NewCrawlError(StageSchedule, nil, err)
 	}
 }
@@ -0,0 +1,572 @@
+package gospider
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestEngineStop(t *testing.T) {
+	// server blocks until released, so requests pile up in engine
+	release := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+		fmt.Fprint(w, "hello")
+	}))
+	defer server.Close()
+
+	downloader, _ := NewDownloader(nil)
+	analyzer, _ := NewAnalyzerSolo(BodyReader)
+	args := NewEngineArgs()
+	args.Downloader = downloader
+	args.Analyzer = analyzer
+	args.Pipeline = NewPipelineSolo(func(item Item) error { return nil })
+	args.DWorkers = 1
+	args.ReqBufSize = 10
+	engine := NewEngine(args)
+
+	generator := make(chan Data)
+	errs := engine.Run(generator)
+	for i := 0; i < 5; i++ {
+		req, _ := NewGetRequest(fmt.Sprintf("%s/%d", server.URL, i))
+		generator <- req
+	}
+
+	// wait until worker picks first request
+	for engine.LenRequests() != 4 {
+		time.Sleep(time.Millisecond)
+	}
+
+	done := make(chan []Data)
+	go func() { done <- engine.Stop() }()
+	time.Sleep(10 * time.Millisecond)
+	close(release)
+
+	var pending []Data
+	select {
+	case pending = <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("engine stop timeout")
+	}
+
+	if len(pending) != 4 && len(pending) != 5 {
+		t.Errorf("engine should return undelivered requests, got %d", len(pending))
+	}
+
+	for _, datum := range pending {
+		if req, ok := datum.(*Request); ok && !req.IgnoreDupe {
+			t.Error("pending request should have filter disabled")
+		}
+	}
+
+	for range errs {
+	}
+
+	if engine.Stop() != nil {
+		t.Error("second stop should take no effect")
+	}
+}
+
+func TestEngineDone(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, r.URL.Path)
+	}))
+	defer server.Close()
+
+	// page "/0" yields child requests "/1" & "/2", others yields item
+	analyzer, _ := NewAnalyzerSolo(func(res *Response) ([]Data, error) {
+		if res.Request.URL.Path == "/0" {
+			a, _ := NewGetRequest(server.URL + "/1")
+			b, _ := NewGetRequest(server.URL + "/2")
+			return []Data{a, b}, nil
+		}
+		return Item{"url": res.Request.URL.String()}.DataList(), nil
+	})
+
+	items := NewCounter()
+	downloader, _ := NewDownloader(nil)
+	args := NewEngineArgs()
+	args.Downloader = downloader
+	args.Analyzer = analyzer
+	args.Pipeline = NewPipelineSolo(func(item Item) error {
+		items.Inc()
+		return nil
+	})
+	engine := NewEngine(args)
+	// setup time before run is not counted in elapsed time
+	time.Sleep(200 * time.Millisecond)
+
+	generator := make(chan Data, 1)
+	req, _ := NewGetRequest(server.URL + "/0")
+	generator <- req
+	close(generator)
+
+	finished := make(chan struct{})
+	go func() {
+		for range engine.Run(generator) {
+		}
+		close(finished)
+	}()
+
+	select {
+	case <-finished:
+	case <-time.After(5 * time.Second):
+		t.Fatal("engine should stop itself when crawl is done")
+	}
+
+	if items.Get() != 2 {
+		t.Errorf("engine should handle all items before done, got %d", items.Get())
+	}
+
+	if !engine.Idle() {
+		t.Error("engine should be idle when done")
+	}
+
+	stats := engine.Stats()
+	if stats.Scheduled != 3 || stats.Downloaded != 3 || stats.Parsed != 3 || stats.Items != 2 {
+		t.Errorf("wrong engine stats: %s", engine.Summary())
+	}
+	if stats.Elapsed >= 200*time.Millisecond {
+		t.Errorf("elapsed time should start from run, got %s", stats.Elapsed)
+	}
+}
+
+func TestEngineRunContext(t *testing.T) {
+	// server hangs until test finish
+	hang := make(chan struct{})
+	defer close(hang)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-hang:
+		case <-r.Context().Done():
+		}
+	}))
+	defer server.Close()
+
+	downloader, _ := NewDownloader(nil)
+	analyzer, _ := NewAnalyzerSolo(BodyReader)
+	args := NewEngineArgs()
+	args.Downloader = downloader
+	args.Analyzer = analyzer
+	args.Pipeline = NewPipelineSolo(func(item Item) error { return nil })
+	engine := NewEngine(args)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	generator := make(chan Data)
+	errs := engine.RunContext(ctx, generator)
+	req, _ := NewGetRequest(server.URL)
+	generator <- req
+
+	time.AfterFunc(50*time.Millisecond, cancel)
+
+	finished := make(chan struct{})
+	go func() {
+		for range errs {
+		}
+		close(finished)
+	}()
+
+	select {
+	case <-finished:
+	case <-time.After(5 * time.Second):
+		t.Fatal("cancel context should abort hung download and stop engine")
+	}
+}
+
+func TestEngineRetry(t *testing.T) {
+	// "/flaky" fails twice before success, "/down" always fails
+	hits := NewCounter()
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/flaky" && hits.Inc() > 2 {
+			fmt.Fprint(w, "ok")
+			return
+		}
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer server.Close()
+
+	codes := make(chan int, 10)
+	analyzer, _ := NewAnalyzerSolo(func(res *Response) ([]Data, error) {
+		codes <- res.StatusCode
+		return nil, nil
+	})
+	downloader, _ := NewDownloader(nil)
+	args := NewEngineArgs()
+	args.Downloader = downloader
+	args.Analyzer = analyzer
+	args.Pipeline = NewPipelineSolo(func(item Item) error { return nil })
+	args.Retry = NewRetryPolicy()
+	args.Retry.BaseDelay = time.Millisecond
+	engine := NewEngine(args)
+
+	generator := make(chan Data, 2)
+	flaky, _ := NewGetRequest(server.URL + "/flaky")
+	down, _ := NewGetRequest(server.URL + "/down")
+	generator <- flaky
+	generator <- down
+	close(generator)
+
+	var exhausted []*CrawlError
+	for err := range engine.Run(generator) {
+		if e, ok := err.(*CrawlError); ok && errors.Is(e, ErrRetryExhausted) {
+			exhausted = append(exhausted, e)
+		}
+	}
+	close(codes)
+
+	var ok, fail int
+	for code := range codes {
+		if code == http.StatusOK {
+			ok++
+		} else {
+			fail++
+		}
+	}
+	if ok != 1 || fail != 1 {
+		t.Errorf("flaky should succeed after retry and down should give final response: %d ok %d fail", ok, fail)
+	}
+
+	if stats := engine.Stats(); stats.Retried != 5 {
+		t.Errorf("expect 2 + 3 retries, got %d", stats.Retried)
+	}
+	if down.RetryTimes() != 3 {
+		t.Errorf("retry times should be kept in meta, got %d", down.RetryTimes())
+	}
+	if len(exhausted) != 1 || exhausted[0].Request.URL.Path != "/down" ||
+		exhausted[0].StatusCode != http.StatusServiceUnavailable || exhausted[0].Retries != 3 {
+		t.Errorf("exhausted retries should be reported with status and retries: %v", exhausted)
+	}
+}
+
+func TestEngineFilterSnapshot(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, r.URL.Path)
+	}))
+	defer server.Close()
+	snapshot := filepath.Join(t.TempDir(), "seen.snapshot")
+
+	// run crawls twice with same snapshot, second one should dedupe everything
+	crawl := func() Stats {
+		downloader, _ := NewDownloader(nil)
+		analyzer, _ := NewAnalyzerSolo(BodyReader)
+		args := NewEngineArgs()
+		args.Downloader = downloader
+		args.Analyzer = analyzer
+		args.Pipeline = NewPipelineSolo(func(item Item) error { return nil })
+		args.FilterSnapshot = snapshot
+		args.FilterSnapshotInterval = time.Millisecond
+		engine := NewEngine(args)
+
+		generator := make(chan Data, 3)
+		for i := 0; i < 3; i++ {
+			req, _ := NewGetRequest(fmt.Sprintf("%s/%d", server.URL, i))
+			generator <- req
+		}
+		close(generator)
+		for range engine.Run(generator) {
+		}
+		return engine.Stats()
+	}
+
+	first := crawl()
+	if first.Downloaded != 3 || first.Filter == nil || first.Filter.Len != 3 {
+		t.Errorf("wrong stats of first crawl: %s", first)
+	}
+	second := crawl()
+	if second.Downloaded != 0 || second.Deduped != 3 {
+		t.Errorf("filter should be restored from snapshot: %s", second)
+	}
+}
+
+func TestEngineErrorStatus(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusAccepted)
+		fmt.Fprint(w, "too large body")
+	}))
+	defer server.Close()
+
+	downloader, _ := NewDownloader(nil, NewBodyMiddleware(BodyPolicy{MaxSize: 4}))
+	analyzer, _ := NewAnalyzerSolo(BodyReader)
+	args := NewEngineArgs()
+	args.Downloader = downloader
+	args.Analyzer = analyzer
+	args.Pipeline = NewPipelineSolo(func(item Item) error { return nil })
+	engine := NewEngine(args)
+
+	generator := make(chan Data, 1)
+	req, _ := NewGetRequest(server.URL)
+	generator <- req
+	close(generator)
+
+	var errs []*CrawlError
+	for err := range engine.Run(generator) {
+		errs = append(errs, err.(*CrawlError))
+	}
+	if len(errs) != 1 || !errors.Is(errs[0], ErrBodyTooLarge) || errs[0].StatusCode != http.StatusAccepted {
+		t.Errorf("download error should carry status of response: %v", errs)
+	}
+}
+
+func TestEngineResume(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, r.URL.Path)
+	}))
+	defer server.Close()
+	dir := t.TempDir()
+
+	// "/0" links to "/1" & "/2", "/1" links to "/3"
+	links := map[string][]string{"/0": {"/1", "/2"}, "/1": {"/3"}}
+	parse := func(res *Response) ([]Data, error) {
+		var data []Data
+		for _, path := range links[res.Request.URL.Path] {
+			req, _ := NewGetRequest(server.URL + path)
+			data = append(data, req)
+		}
+		return data, nil
+	}
+
+	run := func(parser Parser, fetched *sync.Map) Engine {
+		queue, err := NewDiskQueue(dir, 100)
+		if err != nil {
+			t.Fatal(err)
+		}
+		filter, err := NewDiskFilter(dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		analyzer, _ := NewAnalyzerSolo(func(res *Response) ([]Data, error) {
+			fetched.Store(res.Request.URL.Path, true)
+			return parser(res)
+		})
+		downloader, _ := NewDownloader(nil)
+		args := NewEngineArgs()
+		args.Downloader = downloader
+		args.Analyzer = analyzer
+		args.Pipeline = NewPipelineSolo(func(item Item) error { return nil })
+		args.Queue = queue
+		args.Filter = filter
+		return NewEngine(args)
+	}
+
+	// first run crashes while parsing "/1", engine is abandoned without stop
+	crashed, hang := make(chan struct{}), make(chan struct{})
+	defer close(hang)
+	var first sync.Map
+	engine := run(func(res *Response) ([]Data, error) {
+		if res.Request.URL.Path == "/1" {
+			close(crashed)
+			<-hang
+			return nil, nil
+		}
+		return parse(res)
+	}, &first)
+	seed, _ := NewGetRequest(server.URL + "/0")
+	generator := make(chan Data, 1)
+	generator <- seed
+	engine.Run(generator)
+	select {
+	case <-crashed:
+	case <-time.After(5 * time.Second):
+		t.Fatal("first run should reach /1")
+	}
+
+	// second run resumes from disk: "/1" is fetched again and its child is not lost
+	var second sync.Map
+	engine = run(parse, &second)
+	generator = make(chan Data)
+	close(generator)
+	finished := make(chan struct{})
+	go func() {
+		for range engine.Run(generator) {
+		}
+		close(finished)
+	}()
+	select {
+	case <-finished:
+	case <-time.After(5 * time.Second):
+		t.Fatal("resumed engine should finish")
+	}
+
+	if _, ok := second.Load("/0"); ok {
+		t.Error("analyzed page should not be fetched again")
+	}
+	for _, path := range []string{"/1", "/3"} {
+		if _, ok := second.Load(path); !ok {
+			t.Errorf("%s should be crawled after resume", path)
+		}
+	}
+}
+
+func TestEngineSnapshotUnsupported(t *testing.T) {
+	args := NewEngineArgs()
+	args.Downloader, _ = NewDownloader(nil)
+	args.Analyzer, _ = NewAnalyzerSolo(BodyReader)
+	args.Pipeline = NewPipelineSolo(func(item Item) error { return nil })
+	args.Filter = NewCuckooFilter(10)
+	args.FilterSnapshot = filepath.Join(t.TempDir(), "seen.snapshot")
+	args.FilterSnapshotInterval = time.Millisecond
+	engine := NewEngine(args)
+
+	errs := engine.Run(nil)
+	time.Sleep(20 * time.Millisecond)
+	engine.Stop()
+	for err := range errs {
+		t.Errorf("filter that can not be saved should not report every tick: %s", err)
+	}
+}
+
+func TestEngineErrbackFlood(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, r.URL.Path)
+	}))
+	defer server.Close()
+	closed := httptest.NewServer(http.NotFoundHandler())
+	closed.Close()
+
+	// errback yields more requests than queue could hold
+	const n = 5
+	analyzer, _ := NewAnalyzerErrback(ParserMap{KeyDefault: BodyReader},
+		ErrbackMap{"flood": func(req *Request, err error) ([]Data, error) {
+			data := make([]Data, n)
+			for i := range data {
+				data[i], _ = NewGetRequest(fmt.Sprintf("%s/%d", server.URL, i))
+			}
+			return data, nil
+		}})
+	items := NewCounter()
+	downloader, _ := NewDownloader(nil)
+	args := NewEngineArgs()
+	args.Downloader = downloader
+	args.Analyzer = analyzer
+	args.Pipeline = NewPipelineSolo(func(item Item) error {
+		items.Inc()
+		return nil
+	})
+	args.DWorkers = 1
+	args.ReqBufSize = 1
+	engine := NewEngine(args)
+
+	generator := make(chan Data, 1)
+	req, _ := NewGetRequest(closed.URL)
+	generator <- req.SetErrback("flood")
+	close(generator)
+
+	finished := make(chan struct{})
+	go func() {
+		for range engine.Run(generator) {
+		}
+		close(finished)
+	}()
+	select {
+	case <-finished:
+	case <-time.After(5 * time.Second):
+		engine.Stop()
+		t.Fatalf("engine should not block on errback output, inflight %d", engine.Stats().Inflight)
+	}
+	if items.Get() != n {
+		t.Errorf("all requests yield by errback should be crawled, got %d", items.Get())
+	}
+}
+
+func TestEngineRescheduleFlood(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, r.URL.Path)
+	}))
+	defer server.Close()
+
+	// every "/old" request is replaced by "/new" after generator fills queue
+	moved := &hookMiddleware{request: func(req *Request) (Data, error) {
+		if strings.HasPrefix(req.URL.Path, "/old") {
+			time.Sleep(10 * time.Millisecond)
+			return NewGetRequest(server.URL + "/new" + req.URL.Path[4:])
+		}
+		return nil, nil
+	}}
+	items := NewCounter()
+	downloader, _ := NewDownloader(nil, moved)
+	analyzer, _ := NewAnalyzerSolo(BodyReader)
+	args := NewEngineArgs()
+	args.Downloader = downloader
+	args.Analyzer = analyzer
+	args.Pipeline = NewPipelineSolo(func(item Item) error {
+		items.Inc()
+		return nil
+	})
+	args.DWorkers = 1
+	args.ReqBufSize = 1
+	engine := NewEngine(args)
+
+	const n = 5
+	generator := make(chan Data, n)
+	for i := 0; i < n; i++ {
+		req, _ := NewGetRequest(fmt.Sprintf("%s/old%d", server.URL, i))
+		generator <- req
+	}
+	close(generator)
+
+	finished := make(chan struct{})
+	go func() {
+		for range engine.Run(generator) {
+		}
+		close(finished)
+	}()
+	select {
+	case <-finished:
+	case <-time.After(5 * time.Second):
+		engine.Stop()
+		t.Fatalf("engine should not block on rescheduling, inflight %d", engine.Stats().Inflight)
+	}
+	if items.Get() != n {
+		t.Errorf("all rescheduled requests should be crawled, got %d", items.Get())
+	}
+}
+
+func TestEngineHostBlocking(t *testing.T) {
+	var lock sync.Mutex
+	var order []string
+	handler := func(name string) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			lock.Lock()
+			order = append(order, name+r.URL.Path)
+			lock.Unlock()
+			fmt.Fprint(w, r.URL.Path)
+		})
+	}
+	slow := httptest.NewServer(handler("slow"))
+	defer slow.Close()
+	fast := httptest.NewServer(handler("fast"))
+	defer fast.Close()
+
+	queue := plainQueue{NewPriorityQueue(10)}
+	downloader, _ := NewDownloader(nil)
+	analyzer, _ := NewAnalyzerSolo(BodyReader)
+	args := NewEngineArgs()
+	args.Downloader = downloader
+	args.Analyzer = analyzer
+	args.Pipeline = NewPipelineSolo(func(item Item) error { return nil })
+	args.Queue = queue
+	args.DWorkers = 1
+	args.HostPolicies = map[string]HostPolicy{slow.Listener.Addr().String(): {Delay: 200 * time.Millisecond}}
+	engine := NewEngine(args)
+
+	generator := make(chan Data, 4)
+	for _, u := range []string{slow.URL + "/1", slow.URL + "/2", fast.URL + "/1", fast.URL + "/2"} {
+		req, _ := NewGetRequest(u)
+		generator <- req
+	}
+	close(generator)
+	for range engine.Run(generator) {
+	}
+
+	// delayed host does not block requests of other hosts, even with a plain queue
+	if len(order) != 4 || order[3] != "slow/2" {
+		t.Errorf("requests of free host should go first, got %v", order)
+	}
+}
@@ -1,23 +1,49 @@
 package gospider
 
-import "errors"
+import (
+	"errors"
+	"fmt"
+)
 
 // Constant that used as item key for special use
 var (
 	KeyDefault = "_default"
 	KeyData    = "_data"
 	KeyBody    = "_body"
+
+	KeyRetryTimes = "_retry_times"
+	KeyDepth      = "_depth"
+	KeyTTL        = "_ttl"
+	KeyProxy      = "proxy"
+	KeySession    = "session"
+	KeyMaxSize    = "_max_size"
+	KeyStream     = "_stream"
 )
 
 /**************************************************************
 * errors: Scheduler
 **************************************************************/
 var ErrDupeRequest = errors.New("duplicate request")
+var ErrForgetUnsupported = errors.New("filter can not forget")
+var ErrPersistUnsupported = errors.New("filter can not be saved")
 
 /**************************************************************
 * errors: Downloader
 **************************************************************/
 var ErrNilRequest = errors.New("nil request")
+var ErrDropRequest = errors.New("drop request")
+var ErrNilMiddleware = errors.New("nil middleware")
+var ErrInvalidProxy = errors.New("invalid proxy url")
+var ErrProxyUnsupported = errors.New("transport does not support proxy")
+var ErrNoProxy = errors.New("no available proxy")
+var ErrInvalidCookie = errors.New("invalid cookie")
+var ErrRetryExhausted = errors.New("retries exhausted")
+
+// ErrRobotsDisallowed wraps ErrDropRequest, so request is dropped without retry
+var ErrRobotsDisallowed = fmt.Errorf("%w: disallowed by robots.txt", ErrDropRequest)
+
+// ErrBodyTooLarge wraps ErrDropRequest, response is aborted by its Content-Length
+var ErrBodyTooLarge = fmt.Errorf("%w: body too large", ErrDropRequest)
 
 /**************************************************************
 * errors: Analyzer
@@ -64,3 +90,57 @@ var ErrInvalidDataItem = errors.New("invalid data items")
 var ErrResponseFromAnalyzer = errors.New("response from analyzer")
 
 var ErrGenerateInvalidType = errors.New("generate invliad type")
+
+/**************************************************************
+* struct: CrawlError
+**************************************************************/
+
+// Stage indicates where an error occurs
+type Stage string
+
+const (
+	StageSchedule Stage = "schedule"
+	StageDownload Stage = "download"
+	StageAnalyze  Stage = "analyze"
+	StagePipeline Stage = "pipeline"
+)
+
+// CrawlError is error reported by engine with its context attached
+// use errors.Is to compare its cause with sentinels above
+type CrawlError struct {
+	Stage      Stage
+	Request    *Request
+	Item       Item
+	StatusCode int
+	Retries    int
+	Err        error
+}
+
+// NewCrawlError wraps err with stage and originating request (could be nil)
+func NewCrawlError(stage Stage, req *Request, err error) *CrawlError {
+	e := &CrawlError{Stage: stage, Request: req, Err: err}
+	if req != nil {
+		e.Retries = req.RetryTimes()
+	}
+	return e
+}
+
+// CrawlError_Error gives stage, request, status and cause
+func (e *CrawlError) Error() string {
+	msg := "[" + string(e.Stage) + "]"
+	if e.Request != nil {
+		msg += " " + e.Request.Repr()
+	}
+	if e.StatusCode != 0 {
+		msg += fmt.Sprintf(" status=%d", e.StatusCode)
+	}
+	if e.Retries != 0 {
+		msg += fmt.Sprintf(" retries=%d", e.Retries)
+	}
+	return msg + ": " + fmt.Sprint(e.Err)
+}
+
+// CrawlError_Unwrap returns the cause
+func (e *CrawlError) Unwrap() error {
+	return e.Err
+}
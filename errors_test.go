@@ -0,0 +1,28 @@
+package gospider
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+)
+
+func TestCrawlError(t *testing.T) {
+	req, _ := NewGetRequest("http://a.com")
+	req.Meta[KeyRetryTimes] = 2
+	e := NewCrawlError(StageDownload, req, ErrDownloadFail)
+	e.StatusCode = 503
+
+	var err error = fmt.Errorf("wrapped: %w", e)
+	if !errors.Is(err, ErrDownloadFail) {
+		t.Error("crawl error should match its cause")
+	}
+
+	var ce *CrawlError
+	if !errors.As(err, &ce) || ce.Request != req || ce.Stage != StageDownload {
+		t.Error("crawl error should be extracted with errors.As")
+	}
+
+	if msg := e.Error(); msg != "[download] (REQ:http://a.com) status=503 retries=2: download fail" {
+		t.Errorf("wrong error message: %s", msg)
+	}
+}
@@ -9,7 +9,7 @@ import (
 * REDIS
 **************************************************************/
 
-// apk from forceTodoList won't be filtered
+// apk from forceTodoList is refetched regardless of recrawlInterval
 var (
 	Redis    *redis.Client
 	redisURL = map[string]string{
@@ -17,6 +17,7 @@ var (
 		"prod": "redis://:myredis@localhost:6379/0",
 	}
 	pollTimeout       = time.Minute
+	recrawlInterval   = 7 * 24 * time.Hour
 	redisFilterKey    = "ios:app:seen"
 	redisTodoKey      = "ios:app:todo"
 	redisForceTodoKey = "ios:app:todo:force"
@@ -19,28 +19,20 @@ func RequestGenerator(redisURL string) (<-chan Data, error) {
 			if len(res) == 2 {
 				key := res[0]
 				appid := res[1]
-				var req *Request
+				req, err := NewRequest(
+					"GET",
+					PageURL(appid),
+					nil,
+					MetaMap{"id": appid},
+				)
+				if err != nil {
+					continue
+				}
+				// app from force list is fetched even if crawled recently
 				if key == redisForceTodoKey {
-					req, err = NewRequest(
-						"GET",
-						PageURL(appid),
-						nil,
-						MetaMap{"id": appid },
-					)
-					if err == nil {
-						c <- req.DisableFilter()
-					}
-				} else if key == redisTodoKey {
-					req, err = NewRequest(
-						"GET",
-						PageURL(appid),
-						nil,
-						MetaMap{"id": appid},
-					)
-					if err == nil {
-						c <- req
-					}
+					req.SetTTL(0)
 				}
+				c <- req
 			}
 		}
 	}(c)
@@ -4,6 +4,7 @@ import . "github.com/Vonng/gospider"
 import (
 	log "github.com/Sirupsen/logrus"
 	"os"
+	"time"
 )
 
 func BuildEngine() Engine {
@@ -13,7 +14,8 @@ func BuildEngine() Engine {
 		return nil
 	}
 
-	downloader, err := NewDownloader(nil)
+	// app stores block default go user agent
+	downloader, err := NewDownloader(nil, NewUserAgentMiddleware(UserAgentSticky))
 	if err != nil {
 		log.Errorf("build naive ios downloader failed! %s", err.Error())
 		return nil
@@ -26,7 +28,7 @@ func BuildEngine() Engine {
 	}
 
 	args := EngineArgs{
-		Filter:      nil,
+		Filter:      NewTTLFilter(recrawlInterval),
 		Downloader:  downloader,
 		Analyzer:    analyzer,
 		Pipeline:    pipeline,
@@ -35,6 +37,11 @@ func BuildEngine() Engine {
 		ResBufSize:  10000,
 		ItemBufSize: 10000,
 		ErrBufSize:  10000,
+		HostPolicy: HostPolicy{
+			Concurrency: 5,
+			Delay:       100 * time.Millisecond,
+			Jitter:      100 * time.Millisecond,
+		},
 	}
 
 	return NewEngine(&args)
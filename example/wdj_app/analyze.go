@@ -32,6 +32,16 @@ func ParseWdjApp(res *Response) ([]Data, error) {
 	return item.DataList(), nil
 }
 
+// FailWdjApp is errback of app page. it yields an invalid app
+// so that pipeline will mark it as StatusFail
+func FailWdjApp(req *Request, err error) ([]Data, error) {
+	apk := ApkFromPageURL(req.URL.String())
+	if apk == "" {
+		return nil, err
+	}
+	return Item{"apk": apk, "data": NewWdjApp(apk)}.DataList(), nil
+}
+
 const chineseTimeFormat = "2006年01月02日"
 
 // WdjApp_ParseFrom will parse wandoujia App from goquery document.
@@ -10,7 +10,7 @@ import (
 * REDIS
 **************************************************************/
 
-// apk from forceTodoList won't be filtered
+// apk from forceTodoList is refetched regardless of recrawlInterval
 var (
 	Redis    *redis.Client
 	redisURL = map[string]string{
@@ -18,6 +18,7 @@ var (
 		"prod": "redis://:myredis@localhost:6379/0",
 	}
 	pollTimeout       = time.Minute
+	recrawlInterval   = 7 * 24 * time.Hour
 	redisFilterKey    = "wdj:app:seen"
 	redisTodoKey      = "wdj:app:todo"
 	redisForceTodoKey = "wdj:app:todo:force"
@@ -2,6 +2,9 @@ package wdj_app
 
 import . "github.com/Vonng/gospider"
 
+// errbackFail is name of errback which marks app as failed
+const errbackFail = "fail"
+
 // GetGenerator will pull apk name from redis
 func RequestGenerator(redisURL string) (<-chan Data, error) {
 	InitRedis(redisURL)
@@ -19,28 +22,20 @@ func RequestGenerator(redisURL string) (<-chan Data, error) {
 			if len(res) == 2 {
 				key := res[0]
 				apk := res[1]
-				var req *Request
+				req, err := NewRequest(
+					"GET",
+					PageURL(apk),
+					nil,
+					nil,
+				)
+				if err != nil {
+					continue
+				}
+				// apk from force list is fetched even if crawled recently
 				if key == redisForceTodoKey {
-					req, err = NewRequest(
-						"GET",
-						PageURL(apk),
-						nil,
-						nil,
-					)
-					if err == nil {
-						c <- req.DisableFilter()
-					}
-				} else if key == redisTodoKey {
-					req, err = NewRequest(
-						"GET",
-						PageURL(apk),
-						nil,
-						nil,
-					)
-					if err == nil {
-						c <- req
-					}
+					req.SetTTL(0)
 				}
+				c <- req.SetErrback(errbackFail)
 			}
 		}
 	}(c)
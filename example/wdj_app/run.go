@@ -7,13 +7,20 @@ import (
 )
 
 func BuildEngine(redisURL, pgURL string) Engine {
-	analyzer, err := NewAnalyzerSolo(ParseWdjApp)
+	analyzer, err := NewAnalyzerErrback(
+		ParserMap{KeyDefault: ParseWdjApp},
+		ErrbackMap{errbackFail: FailWdjApp},
+	)
 	if err != nil {
 		log.Errorf("build wdj app analyzer failed!", err.Error())
 		return nil
 	}
 
-	downloader, err := NewDownloader(nil)
+	// app stores block default go user agent, apk links should never be read into memory
+	downloader, err := NewDownloader(nil,
+		NewUserAgentMiddleware(UserAgentSticky),
+		NewBodyMiddleware(BodyPolicy{MaxSize: 10 << 20}),
+	)
 	if err != nil {
 		log.Errorf("build wdj app downloader failed! %s", err.Error())
 		return nil
@@ -25,9 +32,9 @@ func BuildEngine(redisURL, pgURL string) Engine {
 		return nil
 	}
 
-	filter, err := NewRedisBloomFilter(redisURL, redisFilterKey)
+	filter, err := NewRedisTTLFilter(redisURL, redisFilterKey, recrawlInterval)
 	if err != nil {
-		log.Errorf("build wdj app redis bloom filter failed! %s", err.Error())
+		log.Errorf("build wdj app redis ttl filter failed! %s", err.Error())
 		return nil
 	}
 
@@ -41,6 +48,7 @@ func BuildEngine(redisURL, pgURL string) Engine {
 		ResBufSize:  10000,
 		ItemBufSize: 10000,
 		ErrBufSize:  10000,
+		AutoThrottle: NewAutoThrottle(),
 	}
 
 	return NewEngine(&args)
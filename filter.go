@@ -1,7 +1,10 @@
 package gospider
 
 import (
+	"bufio"
+	"io"
 	"net/url"
+	"os"
 	"sync"
 	"github.com/go-redis/redis"
 )
@@ -13,92 +16,194 @@ import . "github.com/PuerkitoBio/purell"
 **************************************************************/
 
 // Filter : interface for eliminate duplicate request。
+// implementations identify requests by fingerprint. their constructors take
+// optional FingerprintOptions, Fingerprint's default ones are used if omitted.
+// some also provide SeenURL(key) which takes raw key instead of request, keys
+// of Seen(req) are fingerprints so SeenURL(req.URL.String()) won't match it
 type Filter interface {
 	// Seen indicate whether s is in seen list and update it
 	Seen(req *Request) (bool)
 }
 
+// ForgetFilter is a Filter that could forget seen requests, so they can be fetched again
+type ForgetFilter interface {
+	Filter
+	// Unsee remove req from seen list, report whether it was there
+	Unsee(req *Request) bool
+}
+
+// Forget remove req from filter's seen list if filter supports that
+// ErrForgetUnsupported is returned when filter is not a ForgetFilter
+// probabilistic filters (scalable bloom, cuckoo) can not tell keys apart:
+// forgetting a key never seen but reported as seen (false positive) removes
+// another key's bits or fingerprint, so that key may be crawled again, or a
+// later Forget of it may miss. only forget requests the filter did accept
+func Forget(f Filter, req *Request) (bool, error) {
+	if ff, ok := f.(ForgetFilter); ok {
+		return ff.Unsee(req), nil
+	}
+	return false, ErrForgetUnsupported
+}
+
+// FilterStats describes state of a filter
+type FilterStats struct {
+	// Len is number of unique requests, estimated for probabilistic filters
+	Len int `json:"len"`
+	// Bytes is size of filter state, zero if unknown
+	Bytes int `json:"bytes,omitempty"`
+	// FPRate is estimated false positive rate of probabilistic filters
+	FPRate float64 `json:"fp_rate,omitempty"`
+}
+
+// LenFilter is a Filter that knows how many unique requests it has seen
+type LenFilter interface {
+	Filter
+	Len() int
+}
+
+// StatsFilter is a Filter that reports its state
+type StatsFilter interface {
+	Filter
+	Stats() FilterStats
+}
+
+// PersistentFilter is a Filter that could be saved and restored between runs
+type PersistentFilter interface {
+	Filter
+	// Save write filter state to w
+	Save(w io.Writer) error
+	// Load restore filter state from r, merged into current one if possible
+	Load(r io.Reader) error
+}
+
+// SaveFilter write filter snapshot to file atomically
+// ErrPersistUnsupported is returned when filter is not a PersistentFilter
+func SaveFilter(f Filter, path string) error {
+	pf, ok := f.(PersistentFilter)
+	if !ok {
+		return ErrPersistUnsupported
+	}
+	tmp := path + ".tmp"
+	file, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(file)
+	if err = pf.Save(w); err == nil {
+		err = w.Flush()
+	}
+	if err == nil {
+		err = file.Sync()
+	}
+	if e := file.Close(); err == nil {
+		err = e
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// LoadFilter restore filter from snapshot file written by SaveFilter
+func LoadFilter(f Filter, path string) error {
+	pf, ok := f.(PersistentFilter)
+	if !ok {
+		return ErrPersistUnsupported
+	}
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	return pf.Load(bufio.NewReader(file))
+}
+
 /**************************************************************
 * struct: defaultFilter
 **************************************************************/
 
 // defaultFilter implemented with sync.Map
 type defaultFilter struct {
-	seen sync.Map
+	seen  sync.Map
+	count Counter
+	fp    *FingerprintOptions
 }
 
 // NewMapFilter create a default dupe filter
-func NewMapFilter() Filter {
-	return &defaultFilter{}
+func NewMapFilter(opts ...*FingerprintOptions) Filter {
+	return &defaultFilter{count: NewCounter(), fp: fingerprintOptions(opts)}
 }
 
 // Seen: Caller must guarantee req is not nil
 func (self *defaultFilter) Seen(req *Request) (bool) {
-	_, seen := self.seen.Load(req.URL)
-	self.seen.Store(req.URL, nil)
-	return seen
+	return self.SeenURL(self.fp.Fingerprint(req))
 }
 
-// defaultFilter_SeenURL using url directly instead of request
+// defaultFilter_SeenURL test and set raw key
 func (self *defaultFilter) SeenURL(url string) bool {
-	_, seen := self.seen.Load(url)
-	self.seen.Store(url, nil)
+	_, seen := self.seen.LoadOrStore(url, nil)
+	if !seen {
+		self.count.Inc()
+	}
 	return seen
 }
 
-/**************************************************************
-* struct: redisSetFilter
-**************************************************************/
-
-// redisSetFilter using HyperLogLog to determine whether seen a url
-// It may loss some accuracy trade for memory usage
-// little FP rate: some unseen page could be consider seen
-type redisSetFilter struct {
-	key    string
-	client *redis.Client
-}
-
-// redisSetFilter create a new redis dupe filter using PFADD
-func NewRedisSetFilter(redisURL string, key string) (Filter, error) {
-	ops, err := redis.ParseURL(redisURL);
-	if err != nil {
-		return nil, err
+// defaultFilter_Unsee implements ForgetFilter
+func (self *defaultFilter) Unsee(req *Request) bool {
+	key := self.fp.Fingerprint(req)
+	_, seen := self.seen.Load(key)
+	if seen {
+		self.seen.Delete(key)
+		self.count.Dec()
 	}
-	client := redis.NewClient(ops)
+	return seen
+}
 
-	if _, err = client.Ping().Result(); err != nil {
-		return nil, err
-	}
+// defaultFilter_Len implements LenFilter
+func (self *defaultFilter) Len() int {
+	return int(self.count.Get())
+}
 
-	return &redisSetFilter{key, client}, nil
+// defaultFilter_Stats implements StatsFilter
+func (self *defaultFilter) Stats() FilterStats {
+	return FilterStats{Len: self.Len()}
 }
 
-// redisSetFilter_SeenURL using url directly instead of request
-func (self *redisSetFilter) Seen(req *Request) bool {
-	i, _ := self.client.SAdd(self.key, req.URL).Result()
-	return i == 0
+// defaultFilter_Save write seen keys line by line
+func (self *defaultFilter) Save(w io.Writer) (err error) {
+	self.seen.Range(func(key, _ interface{}) bool {
+		_, err = io.WriteString(w, key.(string)+"\n")
+		return err == nil
+	})
+	return
 }
 
-// redisSetFilter_Seen implemented with PFAdd
-func (self *redisSetFilter) SeenURL(url string) bool {
-	i, _ := self.client.PFAdd(self.key, url).Result()
-	return i == 0
+// defaultFilter_Load add keys written by Save to seen list
+func (self *defaultFilter) Load(r io.Reader) error {
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		if line := scanner.Text(); line != "" {
+			self.SeenURL(line)
+		}
+	}
+	return scanner.Err()
 }
 
 /**************************************************************
-* struct: redisBloomFilter
+* struct: redisSetFilter
 **************************************************************/
 
-// redisBloomFilter using HyperLogLog to determine whether seen a url
-// It may loss some accuracy trade for memory usage
-// little FP rate: some unseen page could be consider seen
-type redisBloomFilter struct {
+// redisSetFilter using redis set to determine whether seen a url
+// it is accurate while memory usage grows with urls
+type redisSetFilter struct {
 	key    string
 	client *redis.Client
+	fp     *FingerprintOptions
 }
 
-// redisBloomFilter create a new redis dupe filter using PFADD
-func NewRedisBloomFilter(redisURL string, key string) (Filter, error) {
+// redisSetFilter create a new redis dupe filter using SADD
+func NewRedisSetFilter(redisURL string, key string, opts ...*FingerprintOptions) (Filter, error) {
 	ops, err := redis.ParseURL(redisURL);
 	if err != nil {
 		return nil, err
@@ -109,21 +214,27 @@ func NewRedisBloomFilter(redisURL string, key string) (Filter, error) {
 		return nil, err
 	}
 
-	return &redisBloomFilter{key, client}, nil
+	return &redisSetFilter{key, client, fingerprintOptions(opts)}, nil
 }
 
-// redisBloomFilter_SeenURL using url directly instead of request
-func (self *redisBloomFilter) Seen(req *Request) bool {
-	i, _ := self.client.PFAdd(self.key, req.URL).Result()
+// redisSetFilter_Seen implemented with SAdd
+func (self *redisSetFilter) Seen(req *Request) bool {
+	i, _ := self.client.SAdd(self.key, self.fp.Fingerprint(req)).Result()
 	return i == 0
 }
 
-// redisBloomFilter_Seen implemented with PFAdd
-func (self *redisBloomFilter) SeenURL(url string) bool {
-	i, _ := self.client.PFAdd(self.key, url).Result()
+// redisSetFilter_SeenURL test and set raw key
+func (self *redisSetFilter) SeenURL(url string) bool {
+	i, _ := self.client.SAdd(self.key, url).Result()
 	return i == 0
 }
 
+// redisSetFilter_Unsee implements ForgetFilter with SRem
+func (self *redisSetFilter) Unsee(req *Request) bool {
+	i, _ := self.client.SRem(self.key, self.fp.Fingerprint(req)).Result()
+	return i == 1
+}
+
 /**************************************************************
 * function: PureURL
 **************************************************************/
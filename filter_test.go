@@ -1,6 +1,9 @@
 package gospider
 
-import "testing"
+import (
+	"path/filepath"
+	"testing"
+)
 
 func TestNewMapFilter(t *testing.T) {
 	filter := NewMapFilter()
@@ -77,3 +80,43 @@ func TestNewRedisBloomFilter(t *testing.T) {
 		t.Error("blind on what already seen (b)")
 	}
 }
+
+func TestMapFilterUnsee(t *testing.T) {
+	filter := NewMapFilter()
+	req, _ := NewGetRequest("http://a.com")
+	filter.Seen(req)
+	if ok, err := Forget(filter, req); !ok || err != nil {
+		t.Error("map filter should forget seen request")
+	}
+	if filter.Seen(req) {
+		t.Error("forgotten request should not be seen")
+	}
+}
+
+func TestMapFilterPersist(t *testing.T) {
+	filter := NewMapFilter().(*defaultFilter)
+	for _, u := range []string{"http://a.com", "http://b.com", "http://a.com"} {
+		req, _ := NewGetRequest(u)
+		filter.Seen(req)
+	}
+	if filter.Len() != 2 || filter.Stats().Len != 2 {
+		t.Errorf("wrong filter len %d", filter.Len())
+	}
+
+	path := filepath.Join(t.TempDir(), "seen")
+	if err := SaveFilter(filter, path); err != nil {
+		t.Fatal(err)
+	}
+	restored := NewMapFilter()
+	if err := LoadFilter(restored, path); err != nil {
+		t.Fatal(err)
+	}
+	req, _ := NewGetRequest("http://b.com")
+	if !restored.Seen(req) || restored.(LenFilter).Len() != 2 {
+		t.Error("map filter should be restored")
+	}
+
+	if err := SaveFilter(NewCuckooFilter(10), path); err != ErrPersistUnsupported {
+		t.Error("cuckoo filter can not be saved")
+	}
+}
@@ -0,0 +1,95 @@
+package gospider
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+)
+
+/**************************************************************
+* struct: FingerprintOptions
+**************************************************************/
+
+// FingerprintOptions controls what makes two requests the same
+type FingerprintOptions struct {
+	// Headers are names of headers taken into account. ignored by default
+	Headers []string
+
+	// IgnoreParams are query params ignored, e.g. session id or tracking params
+	IgnoreParams []string
+}
+
+// defaultFingerprint is used by Fingerprint and filters created without options
+// it is never modified, zero options mean no header and no ignored param
+var defaultFingerprint = &FingerprintOptions{}
+
+// Fingerprint returns canonical fingerprint of request with default options
+func Fingerprint(req *Request) string {
+	return defaultFingerprint.Fingerprint(req)
+}
+
+// fingerprintOptions returns a private copy of first given options for a filter
+// so changing options afterward never changes keys of a filter holding data
+func fingerprintOptions(opts []*FingerprintOptions) *FingerprintOptions {
+	if len(opts) == 0 || opts[0] == nil {
+		return defaultFingerprint
+	}
+	return &FingerprintOptions{
+		Headers:      append([]string(nil), opts[0].Headers...),
+		IgnoreParams: append([]string(nil), opts[0].IgnoreParams...),
+	}
+}
+
+// FingerprintOptions_Fingerprint returns sha1 hex of method, normalized url
+// with sorted query params, body hash and chosen headers
+// streaming body is buffered by BodyBytes, so request still sends it afterward
+func (self *FingerprintOptions) Fingerprint(req *Request) string {
+	h := sha1.New()
+	method := strings.ToUpper(req.Method)
+	if method == "" {
+		method = http.MethodGet
+	}
+	h.Write([]byte(method))
+	h.Write([]byte{'\n'})
+	h.Write([]byte(self.canonicalURL(req.URL)))
+	h.Write([]byte{'\n'})
+
+	if body, err := req.BodyBytes(); err == nil && len(body) > 0 {
+		sum := sha1.Sum(body)
+		h.Write(sum[:])
+	}
+	h.Write([]byte{'\n'})
+
+	if len(self.Headers) > 0 {
+		names := make([]string, len(self.Headers))
+		for i, name := range self.Headers {
+			names[i] = http.CanonicalHeaderKey(name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			values := req.Header[name]
+			h.Write([]byte(name + ":" + strings.Join(values, ",") + "\n"))
+		}
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// FingerprintOptions_canonicalURL normalize url with PureURL after
+// removing ignored params and sorting the others
+func (self *FingerprintOptions) canonicalURL(u *url.URL) string {
+	if u == nil {
+		return ""
+	}
+	c := *u
+	query := c.Query()
+	for _, param := range self.IgnoreParams {
+		query.Del(param)
+	}
+	// Encode sorts by key, keep values order
+	c.RawQuery = query.Encode()
+	c.ForceQuery = false
+	return PureURL(&c)
+}
@@ -0,0 +1,114 @@
+package gospider
+
+import (
+	"errors"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"testing/iotest"
+)
+
+func TestFingerprint(t *testing.T) {
+	fp := func(method, url, body string) string {
+		req, err := NewRequest(method, url, strings.NewReader(body), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return Fingerprint(req)
+	}
+
+	if fp("GET", "http://a.com/x?b=2&a=1", "") != fp("get", "http://A.com:80/x?a=1&b=2", "") {
+		t.Error("query order, method case and host case should not matter")
+	}
+	if fp("GET", "http://a.com/x", "") == fp("POST", "http://a.com/x", "") {
+		t.Error("method should matter")
+	}
+	if fp("POST", "http://a.com/x", "k=1") == fp("POST", "http://a.com/x", "k=2") {
+		t.Error("body should matter")
+	}
+
+	// body still readable after fingerprint
+	req, _ := NewRequest("POST", "http://a.com/x", strings.NewReader("k=1"), nil)
+	first := Fingerprint(req)
+	if Fingerprint(req) != first {
+		t.Error("fingerprint should be stable")
+	}
+	if body, _ := req.BodyBytes(); string(body) != "k=1" {
+		t.Errorf("body consumed: %q", body)
+	}
+
+	// streaming body without GetBody is still sent after filter saw it
+	received := make(chan string, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		received <- string(body)
+	}))
+	defer server.Close()
+	req, _ = NewRequest("POST", server.URL, io.MultiReader(strings.NewReader("k=1")), nil)
+	if NewMapFilter().Seen(req) {
+		t.Error("you can not see what you haven't seen")
+	}
+	if _, err := http.DefaultClient.Do(req.Request); err != nil || <-received != "k=1" {
+		t.Errorf("request should still send its body after Seen: %v", err)
+	}
+
+	// body read halfway is put back
+	failing := io.MultiReader(strings.NewReader("k="), iotest.ErrReader(errors.New("broken")))
+	req, _ = NewRequest("POST", "http://a.com/x", failing, nil)
+	Fingerprint(req)
+	if head, _ := ioutil.ReadAll(req.Body); string(head) != "k=" {
+		t.Errorf("bytes read before failure should be kept: %q", head)
+	}
+
+	opts := &FingerprintOptions{Headers: []string{"accept-language"}, IgnoreParams: []string{"sid"}}
+	reqA, _ := NewRequest("GET", "http://a.com/x?id=1&sid=abc", nil, nil)
+	reqB, _ := NewRequest("GET", "http://a.com/x?sid=def&id=1", nil, nil)
+	if opts.Fingerprint(reqA) != opts.Fingerprint(reqB) {
+		t.Error("ignored params should not matter")
+	}
+	reqB.Header.Set("Accept-Language", "zh-CN")
+	if opts.Fingerprint(reqA) == opts.Fingerprint(reqB) {
+		t.Error("included headers should matter")
+	}
+}
+
+func TestMapFilterDistinctRequests(t *testing.T) {
+	filter := NewMapFilter()
+	reqA, _ := NewGetRequest("http://a.com/x?a=1&b=2")
+	reqB, _ := NewGetRequest("http://a.com/x?b=2&a=1")
+	if filter.Seen(reqA) {
+		t.Error("you can not see what you haven't seen")
+	}
+	if !filter.Seen(reqB) {
+		t.Error("equivalent request with another *url.URL should be seen")
+	}
+}
+
+func TestFilterFingerprintOptions(t *testing.T) {
+	opts := &FingerprintOptions{IgnoreParams: []string{"sid"}}
+	filter := NewMapFilter(opts)
+	plain := NewMapFilter()
+	opts.IgnoreParams = nil
+
+	reqA, _ := NewGetRequest("http://a.com/x?id=1&sid=abc")
+	reqB, _ := NewGetRequest("http://a.com/x?id=1&sid=def")
+	filter.Seen(reqA)
+	plain.Seen(reqA)
+	if !filter.Seen(reqB) {
+		t.Error("filter should keep options given at creation")
+	}
+	if plain.Seen(reqB) {
+		t.Error("filter without options should use default ones")
+	}
+
+	// SeenURL takes raw key, matching Seen only with the fingerprint
+	if !plain.(*defaultFilter).SeenURL(Fingerprint(reqA)) {
+		t.Error("fingerprint of seen request should be seen")
+	}
+	if plain.(*defaultFilter).SeenURL(reqA.URL.String()) {
+		t.Error("raw url is a different key from fingerprint")
+	}
+}
@@ -0,0 +1,132 @@
+package gospider
+
+import (
+	"math/rand"
+	"net/http"
+	"sync"
+	"time"
+)
+
+/**************************************************************
+* DownloaderMiddleware: default headers
+**************************************************************/
+
+// headerMiddleware set default headers on requests
+type headerMiddleware struct {
+	NopDownloaderMiddleware
+	headers http.Header
+}
+
+// NewHeaderMiddleware set given headers on requests lacking them
+// headers already set on Request.Header always win
+// Referer is set by RefererMiddleware of analyzer, not by downloader middlewares
+func NewHeaderMiddleware(headers http.Header) DownloaderMiddleware {
+	h := make(http.Header, len(headers))
+	for key, values := range headers {
+		h[http.CanonicalHeaderKey(key)] = append([]string(nil), values...)
+	}
+	return &headerMiddleware{headers: h}
+}
+
+func (self *headerMiddleware) ProcessRequest(req *Request) (Data, error) {
+	owned := false
+	for key, values := range self.headers {
+		if _, ok := req.Header[key]; !ok {
+			if !owned {
+				ownHeader(req, len(self.headers))
+				owned = true
+			}
+			req.Header[key] = append([]string(nil), values...)
+		}
+	}
+	return nil, nil
+}
+
+// ownHeader gives req a private copy of its header before it is modified
+// requests copied from one another share the same header map
+func ownHeader(req *Request, n int) {
+	if req.Header == nil {
+		req.Header = make(http.Header, n)
+		return
+	}
+	req.Header = req.Header.Clone()
+}
+
+/**************************************************************
+* DownloaderMiddleware: user agent
+**************************************************************/
+
+// UserAgentStrategy decides which user agent is picked for a request
+type UserAgentStrategy int
+
+const (
+	// UserAgentRoundRobin picks user agents in turn
+	UserAgentRoundRobin UserAgentStrategy = iota
+	// UserAgentRandom picks user agent randomly
+	UserAgentRandom
+	// UserAgentSticky binds each host to one random user agent
+	UserAgentSticky
+)
+
+// DefaultUserAgents are common desktop browsers user agents
+var DefaultUserAgents = []string{
+	"Mozilla/5.0 (Windows NT 10.0; Win64; x64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/120.0.0.0 Safari/537.36",
+	"Mozilla/5.0 (Macintosh; Intel Mac OS X 10_15_7) AppleWebKit/605.1.15 (KHTML, like Gecko) Version/17.1 Safari/605.1.15",
+	"Mozilla/5.0 (Windows NT 10.0; Win64; x64; rv:121.0) Gecko/20100101 Firefox/121.0",
+	"Mozilla/5.0 (X11; Linux x86_64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/120.0.0.0 Safari/537.36",
+}
+
+// userAgentMiddleware rotates User-Agent header of requests
+type userAgentMiddleware struct {
+	NopDownloaderMiddleware
+	strategy UserAgentStrategy
+	agents   []string
+
+	lock   sync.Mutex
+	next   int
+	sticky map[string]string
+	rand   *rand.Rand
+}
+
+// NewUserAgentMiddleware set User-Agent of requests lacking it from agents
+// DefaultUserAgents are used if agents is empty
+func NewUserAgentMiddleware(strategy UserAgentStrategy, agents ...string) DownloaderMiddleware {
+	if len(agents) == 0 {
+		agents = DefaultUserAgents
+	}
+	return &userAgentMiddleware{
+		strategy: strategy,
+		agents:   append([]string(nil), agents...),
+		sticky:   make(map[string]string),
+		rand:     rand.New(rand.NewSource(time.Now().UnixNano())),
+	}
+}
+
+func (self *userAgentMiddleware) ProcessRequest(req *Request) (Data, error) {
+	if req.Header.Get("User-Agent") == "" {
+		ownHeader(req, 1)
+		req.Header.Set("User-Agent", self.pick(requestHost(req)))
+	}
+	return nil, nil
+}
+
+// userAgentMiddleware_pick choose user agent for host according to strategy
+func (self *userAgentMiddleware) pick(host string) string {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	switch self.strategy {
+	case UserAgentRandom:
+		return self.agents[self.rand.Intn(len(self.agents))]
+	case UserAgentSticky:
+		agent, ok := self.sticky[host]
+		if !ok {
+			agent = self.agents[self.rand.Intn(len(self.agents))]
+			self.sticky[host] = agent
+		}
+		return agent
+	default:
+		agent := self.agents[self.next]
+		self.next = (self.next + 1) % len(self.agents)
+		return agent
+	}
+}
@@ -0,0 +1,98 @@
+package gospider
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestHeaderMiddleware(t *testing.T) {
+	m := NewHeaderMiddleware(http.Header{
+		"accept-language": {"zh-CN"},
+		"Accept":          {"text/html"},
+	})
+	req, _ := NewGetRequest("http://a.com")
+	req.Header.Set("Accept", "application/json")
+	m.ProcessRequest(req)
+	if req.Header.Get("Accept-Language") != "zh-CN" {
+		t.Error("default header should be set")
+	}
+	if req.Header.Get("Accept") != "application/json" {
+		t.Error("request header should win")
+	}
+
+	// requests copied from one another share header map
+	copied := *req
+	copied.Request = req.Request.Clone(req.Context())
+	copied.Header = req.Header
+	copied.Header.Del("Accept-Language")
+	m.ProcessRequest(&copied)
+	if req.Header.Get("Accept-Language") != "" {
+		t.Error("shared header should not be modified")
+	}
+}
+
+func TestRefererMiddlewareSharedHeader(t *testing.T) {
+	shared := http.Header{}
+	childA, _ := NewGetRequest("http://a.com/1")
+	childB, _ := NewGetRequest("http://a.com/2")
+	childA.Header, childB.Header = shared, shared
+	noHeader := &Request{Request: &http.Request{URL: childA.URL}}
+
+	res := FakeResponse("http://a.com/", "")
+	RefererMiddleware{}.ProcessOutput(res, []Data{childA, noHeader})
+	if childA.Header.Get("Referer") != "http://a.com/" || noHeader.Header.Get("Referer") != "http://a.com/" {
+		t.Error("referer should be set on child requests")
+	}
+	if len(shared) != 0 || childB.Header.Get("Referer") != "" {
+		t.Error("shared header should not be modified")
+	}
+}
+
+func TestUserAgentMiddleware(t *testing.T) {
+	ua := func(m DownloaderMiddleware, u string) string {
+		req, _ := NewGetRequest(u)
+		m.ProcessRequest(req)
+		return req.UserAgent()
+	}
+
+	rr := NewUserAgentMiddleware(UserAgentRoundRobin, "a", "b")
+	if ua(rr, "http://x.com") != "a" || ua(rr, "http://x.com") != "b" || ua(rr, "http://x.com") != "a" {
+		t.Error("round robin user agent should rotate in turn")
+	}
+
+	random := NewUserAgentMiddleware(UserAgentRandom, "a", "b")
+	seen := map[string]bool{}
+	for i := 0; i < 100; i++ {
+		seen[ua(random, "http://x.com")] = true
+	}
+	if !seen["a"] || !seen["b"] {
+		t.Error("random user agent should pick all agents")
+	}
+
+	sticky := NewUserAgentMiddleware(UserAgentSticky, "a", "b", "c", "d")
+	first := ua(sticky, "http://x.com/1")
+	for i := 0; i < 10; i++ {
+		if ua(sticky, "http://x.com/2") != first {
+			t.Error("sticky user agent should not change for same host")
+		}
+	}
+
+	req, _ := NewGetRequest("http://x.com")
+	req.Header.Set("User-Agent", "mine")
+	rr.ProcessRequest(req)
+	if req.UserAgent() != "mine" {
+		t.Error("request user agent should win")
+	}
+
+	shared := http.Header{}
+	reqA, _ := NewGetRequest("http://x.com")
+	reqA.Header = shared
+	rr.ProcessRequest(reqA)
+	if reqA.UserAgent() == "" || len(shared) != 0 {
+		t.Error("user agent should be set on private copy of header")
+	}
+
+	if ua(NewUserAgentMiddleware(UserAgentRandom), "http://x.com") == "" {
+		t.Error("default user agents should be used")
+	}
+}
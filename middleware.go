@@ -0,0 +1,428 @@
+package gospider
+
+import (
+	"errors"
+	"context"
+	"fmt"
+	"strings"
+	log "github.com/Sirupsen/logrus"
+)
+
+/**************************************************************
+* interface: DownloaderMiddleware
+**************************************************************/
+
+// DownloaderMiddleware hooks into download process
+//
+// Each hook returns (nil, nil) to go on. Non-nil Data short-circuits:
+// *Response is used as download result, *Request is rescheduled instead.
+// Return ErrDropRequest to drop the request silently.
+type DownloaderMiddleware interface {
+	// ProcessRequest is invoked in order before request is sent
+	ProcessRequest(req *Request) (Data, error)
+
+	// ProcessResponse is invoked in reverse order after response received
+	// it could replace response by returning a new one
+	ProcessResponse(req *Request, res *Response) (Data, error)
+
+	// ProcessError is invoked in reverse order when download fails
+	// returned error (if any) replaces origin error for following hooks
+	ProcessError(req *Request, err error) (Data, error)
+}
+
+// NopDownloaderMiddleware does nothing. embed it to implement part of hooks
+type NopDownloaderMiddleware struct{}
+
+func (NopDownloaderMiddleware) ProcessRequest(req *Request) (Data, error) {
+	return nil, nil
+}
+
+func (NopDownloaderMiddleware) ProcessResponse(req *Request, res *Response) (Data, error) {
+	return nil, nil
+}
+
+func (NopDownloaderMiddleware) ProcessError(req *Request, err error) (Data, error) {
+	return nil, nil
+}
+
+// ContextDownloaderMiddleware is middleware whose ProcessRequest may block,
+// chain calls ProcessRequestContext with download context instead
+type ContextDownloaderMiddleware interface {
+	DownloaderMiddleware
+	ProcessRequestContext(ctx context.Context, req *Request) (Data, error)
+}
+
+/**************************************************************
+* struct: Reschedule
+**************************************************************/
+
+// Reschedule is returned by Downloader when request is replaced by a new one
+// engine will schedule Request instead of reporting an error
+type Reschedule struct {
+	Request *Request
+}
+
+func (e *Reschedule) Error() string {
+	return fmt.Sprintf("reschedule %s", e.Request.Repr())
+}
+
+/**************************************************************
+* struct: chainDownloader
+**************************************************************/
+
+// chainDownloader wraps a downloader with ordered middlewares
+type chainDownloader struct {
+	Downloader
+	middlewares []DownloaderMiddleware
+}
+
+// NewDownloaderChain wraps given downloader with ordered middlewares
+func NewDownloaderChain(downloader Downloader, middlewares ...DownloaderMiddleware) Downloader {
+	if len(middlewares) == 0 {
+		return downloader
+	}
+	return &chainDownloader{
+		Downloader:  downloader,
+		middlewares: middlewares,
+	}
+}
+
+// chainDownloader_Download will download request through middlewares
+func (self *chainDownloader) Download(req *Request) (*Response, error) {
+	return self.DownloadContext(context.Background(), req)
+}
+
+// chainDownloader_DownloadContext will download request through middlewares
+func (self *chainDownloader) DownloadContext(ctx context.Context, req *Request) (*Response, error) {
+	if req == nil {
+		return nil, ErrNilRequest
+	}
+
+	var res *Response
+	var err error
+	for _, m := range self.middlewares {
+		var datum Data
+		if cm, ok := m.(ContextDownloaderMiddleware); ok {
+			datum, err = cm.ProcessRequestContext(ctx, req)
+		} else {
+			datum, err = m.ProcessRequest(req)
+		}
+		if err != nil {
+			break
+		}
+		if datum != nil {
+			if res, err = self.resolve(datum); err != nil {
+				return nil, err
+			}
+			break
+		}
+	}
+
+	if res == nil && err == nil {
+		res, err = DownloadContext(ctx, self.Downloader, req)
+	}
+
+	if err != nil {
+		if errors.Is(err, ErrDropRequest) {
+			return res, err
+		}
+		for i := len(self.middlewares) - 1; i >= 0; i-- {
+			datum, e := self.middlewares[i].ProcessError(req, err)
+			if e != nil {
+				err = e
+			}
+			if datum != nil {
+				if res, err = self.replace(res, datum); err != nil {
+					return nil, err
+				}
+				break
+			}
+		}
+		if err != nil {
+			return res, err
+		}
+	}
+
+	for i := len(self.middlewares) - 1; i >= 0; i-- {
+		datum, e := self.middlewares[i].ProcessResponse(req, res)
+		if e != nil {
+			return res, e
+		}
+		if datum != nil {
+			if res, err = self.replace(res, datum); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return res, nil
+}
+
+// chainDownloader_resolve turns data yield by middleware into download result
+// *Request is wrapped as Reschedule error
+func (self *chainDownloader) resolve(datum Data) (*Response, error) {
+	switch v := datum.(type) {
+	case *Response:
+		return v, nil
+	case *Request:
+		return nil, &Reschedule{v}
+	default:
+		return nil, ErrInvalidDataItem
+	}
+}
+
+// chainDownloader_replace resolve datum as result in place of res
+// res is closed unless it is returned again, so no body is left open
+func (self *chainDownloader) replace(res *Response, datum Data) (*Response, error) {
+	next, err := self.resolve(datum)
+	if res != next {
+		closeResponse(res)
+	}
+	return next, err
+}
+
+/**************************************************************
+* interface: SpiderMiddleware
+**************************************************************/
+
+// SpiderMiddleware hooks around Analyzer input and output
+type SpiderMiddleware interface {
+	// ProcessInput is invoked in order before response is analyzed
+	// return error to skip parsing, then ProcessError is invoked
+	ProcessInput(res *Response) error
+
+	// ProcessOutput is invoked in reverse order with data yield by parser
+	// returned list replaces origin one, so data could be filtered, rewritten or added
+	ProcessOutput(res *Response, data []Data) ([]Data, error)
+
+	// ProcessError is invoked in reverse order when parser returns error
+	// non-nil data handles the error and goes on to remaining ProcessOutput
+	ProcessError(res *Response, err error) ([]Data, error)
+}
+
+// NopSpiderMiddleware does nothing. embed it to implement part of hooks
+type NopSpiderMiddleware struct{}
+
+func (NopSpiderMiddleware) ProcessInput(res *Response) error {
+	return nil
+}
+
+func (NopSpiderMiddleware) ProcessOutput(res *Response, data []Data) ([]Data, error) {
+	return data, nil
+}
+
+func (NopSpiderMiddleware) ProcessError(res *Response, err error) ([]Data, error) {
+	return nil, nil
+}
+
+/**************************************************************
+* struct: chainAnalyzer
+**************************************************************/
+
+// chainAnalyzer wraps an analyzer with ordered spider middlewares
+type chainAnalyzer struct {
+	Analyzer
+	middlewares []SpiderMiddleware
+}
+
+// NewAnalyzerChain wraps given analyzer with ordered spider middlewares
+func NewAnalyzerChain(analyzer Analyzer, middlewares ...SpiderMiddleware) Analyzer {
+	if len(middlewares) == 0 {
+		return analyzer
+	}
+	return &chainAnalyzer{
+		Analyzer:    analyzer,
+		middlewares: middlewares,
+	}
+}
+
+// chainAnalyzer_Analyze will analyze response through middlewares
+func (self *chainAnalyzer) Analyze(res *Response) ([]Data, error) {
+	return self.AnalyzeContext(context.Background(), res)
+}
+
+// chainAnalyzer_AnalyzeContext will analyze response through middlewares
+func (self *chainAnalyzer) AnalyzeContext(ctx context.Context, res *Response) ([]Data, error) {
+	if res == nil {
+		return nil, ErrNilResponse
+	}
+
+	var data []Data
+	var err error
+	for _, m := range self.middlewares {
+		if err = m.ProcessInput(res); err != nil {
+			break
+		}
+	}
+	if err == nil {
+		data, err = AnalyzeContext(ctx, self.Analyzer, res)
+	}
+
+	// index of middleware from which ProcessOutput goes on
+	from := len(self.middlewares) - 1
+	if err != nil && ctx.Err() == nil {
+		for i := len(self.middlewares) - 1; i >= 0; i-- {
+			handled, e := self.middlewares[i].ProcessError(res, err)
+			if e != nil {
+				err = e
+			}
+			if handled != nil {
+				data = append(data, handled...)
+				err = nil
+				from = i - 1
+				break
+			}
+		}
+	}
+
+	for i := from; i >= 0; i-- {
+		var e error
+		if data, e = self.middlewares[i].ProcessOutput(res, data); e != nil {
+			return data, e
+		}
+	}
+	return data, err
+}
+
+// chainAnalyzer_HandleError delegates to wrapped analyzer, data yield by errback
+// goes through ProcessOutput like parser output. since there is no response,
+// middlewares get one holding failed request only (Response.Response is nil)
+func (self *chainAnalyzer) HandleError(req *Request, err error) ([]Data, error) {
+	ea, ok := self.Analyzer.(ErrbackAnalyzer)
+	if !ok {
+		return nil, ErrCallbackNotFount
+	}
+	data, err := ea.HandleError(req, err)
+	if err == ErrCallbackNotFount {
+		return nil, err
+	}
+
+	res := &Response{Request: req}
+	for i := len(self.middlewares) - 1; i >= 0; i-- {
+		var e error
+		if data, e = self.middlewares[i].ProcessOutput(res, data); e != nil {
+			return data, e
+		}
+	}
+	return data, err
+}
+
+/**************************************************************
+* SpiderMiddleware: offsite, depth, referer, item size
+**************************************************************/
+
+// offsiteMiddleware drops requests toward hosts not in allowed domains
+type offsiteMiddleware struct {
+	NopSpiderMiddleware
+	domains []string
+}
+
+// NewOffsiteMiddleware allow requests to given domains and their sub domains
+func NewOffsiteMiddleware(domains ...string) SpiderMiddleware {
+	list := make([]string, 0, len(domains))
+	for _, d := range domains {
+		list = append(list, strings.ToLower(d))
+	}
+	return &offsiteMiddleware{domains: list}
+}
+
+func (self *offsiteMiddleware) ProcessOutput(res *Response, data []Data) ([]Data, error) {
+	return filterRequests(data, func(req *Request) bool {
+		host := strings.ToLower(req.URL.Hostname())
+		for _, d := range self.domains {
+			if host == d || strings.HasSuffix(host, "."+d) {
+				return true
+			}
+		}
+		log.Debugf("[SPID] drop offsite request %s", req.URL)
+		return false
+	}), nil
+}
+
+// depthMiddleware keeps depth in Meta[KeyDepth] and drops too deep requests
+type depthMiddleware struct {
+	NopSpiderMiddleware
+	maxDepth int
+}
+
+// NewDepthMiddleware limits depth of requests. depth of seed requests is 0
+func NewDepthMiddleware(maxDepth int) SpiderMiddleware {
+	return &depthMiddleware{maxDepth: maxDepth}
+}
+
+func (self *depthMiddleware) ProcessOutput(res *Response, data []Data) ([]Data, error) {
+	depth := 1
+	if res.Request != nil {
+		if d, ok := res.Request.Meta.GetInt(KeyDepth); ok {
+			depth = d + 1
+		}
+	}
+	return filterRequests(data, func(req *Request) bool {
+		if depth > self.maxDepth {
+			log.Debugf("[SPID] drop request %s exceed depth %d", req.URL, self.maxDepth)
+			return false
+		}
+		if req.Meta == nil {
+			req.Meta = make(MetaMap, 1)
+		}
+		req.Meta[KeyDepth] = depth
+		return true
+	}), nil
+}
+
+// RefererMiddleware set Referer header of child requests to parent url
+// Referer already set on child request is kept. it is not wired by default:
+// pass RefererMiddleware{} to NewAnalyzer to send Referer automatically
+type RefererMiddleware struct {
+	NopSpiderMiddleware
+}
+
+func (RefererMiddleware) ProcessOutput(res *Response, data []Data) ([]Data, error) {
+	if res.Request == nil || res.Request.URL == nil {
+		return data, nil
+	}
+	referer := res.Request.URL.String()
+	return filterRequests(data, func(req *Request) bool {
+		if req.Header.Get("Referer") == "" {
+			ownHeader(req, 1)
+			req.Header.Set("Referer", referer)
+		}
+		return true
+	}), nil
+}
+
+// itemSizeMiddleware drops items whose json size exceed limit
+type itemSizeMiddleware struct {
+	NopSpiderMiddleware
+	maxBytes int
+}
+
+// NewItemSizeMiddleware drops items larger than maxBytes when marshaled
+func NewItemSizeMiddleware(maxBytes int) SpiderMiddleware {
+	return &itemSizeMiddleware{maxBytes: maxBytes}
+}
+
+func (self *itemSizeMiddleware) ProcessOutput(res *Response, data []Data) ([]Data, error) {
+	list := data[:0]
+	for _, datum := range data {
+		if item, ok := datum.(Item); ok {
+			if buf, err := item.Marshal(); err == nil && len(buf) > self.maxBytes {
+				log.Warnf("[SPID] drop item of %d bytes", len(buf))
+				continue
+			}
+		}
+		list = append(list, datum)
+	}
+	return list, nil
+}
+
+// filterRequests keeps data except requests rejected by keep
+func filterRequests(data []Data, keep func(req *Request) bool) []Data {
+	list := data[:0]
+	for _, datum := range data {
+		if req, ok := datum.(*Request); ok && (req.URL == nil || !keep(req)) {
+			continue
+		}
+		list = append(list, datum)
+	}
+	return list
+}
@@ -0,0 +1,266 @@
+package gospider
+
+import (
+	"errors"
+	"testing"
+)
+
+// fakeDownloader yields response with request url as body, fail on path "/fail"
+type fakeDownloader struct {
+	hits Counter
+}
+
+func (self *fakeDownloader) Download(req *Request) (*Response, error) {
+	self.hits.Inc()
+	if req.URL.Path == "/fail" {
+		return nil, errors.New("fake download fail")
+	}
+	res := FakeResponse(req.URL.String(), req.URL.String())
+	res.Request = req
+	return res, nil
+}
+
+// downloaderFunc implement Downloader with a func
+type downloaderFunc func(req *Request) (*Response, error)
+
+func (f downloaderFunc) Download(req *Request) (*Response, error) {
+	return f(req)
+}
+
+// hookMiddleware implement DownloaderMiddleware with funcs
+type hookMiddleware struct {
+	NopDownloaderMiddleware
+	request  func(req *Request) (Data, error)
+	response func(req *Request, res *Response) (Data, error)
+	error    func(req *Request, err error) (Data, error)
+}
+
+func (self *hookMiddleware) ProcessRequest(req *Request) (Data, error) {
+	if self.request == nil {
+		return nil, nil
+	}
+	return self.request(req)
+}
+
+func (self *hookMiddleware) ProcessResponse(req *Request, res *Response) (Data, error) {
+	if self.response == nil {
+		return nil, nil
+	}
+	return self.response(req, res)
+}
+
+func (self *hookMiddleware) ProcessError(req *Request, err error) (Data, error) {
+	if self.error == nil {
+		return nil, nil
+	}
+	return self.error(req, err)
+}
+
+func TestDownloaderChain(t *testing.T) {
+	fake := &fakeDownloader{hits: NewCounter()}
+	cached := FakeResponse("http://cache.com/", "cached")
+	var order []string
+
+	downloader := NewDownloaderChain(fake,
+		&hookMiddleware{
+			request: func(req *Request) (Data, error) {
+				order = append(order, "req1")
+				req.Header.Set("X-Test", "1")
+				return nil, nil
+			},
+			response: func(req *Request, res *Response) (Data, error) {
+				order = append(order, "res1")
+				return nil, nil
+			},
+		},
+		&hookMiddleware{
+			request: func(req *Request) (Data, error) {
+				order = append(order, "req2")
+				switch req.URL.Host {
+				case "cache.com":
+					return cached, nil
+				case "drop.com":
+					return nil, ErrDropRequest
+				case "moved.com":
+					r, _ := NewGetRequest("http://new.com/")
+					return r, nil
+				}
+				return nil, nil
+			},
+			response: func(req *Request, res *Response) (Data, error) {
+				order = append(order, "res2")
+				return nil, nil
+			},
+			error: func(req *Request, err error) (Data, error) {
+				return cached, nil
+			},
+		},
+	)
+
+	req, _ := NewGetRequest("http://a.com/")
+	if res, err := downloader.Download(req); err != nil || res.Request != req {
+		t.Error("chain should download normally")
+	}
+	if req.Header.Get("X-Test") != "1" {
+		t.Error("middleware should be able to modify request")
+	}
+	if got := order; len(got) != 4 || got[0] != "req1" || got[1] != "req2" || got[2] != "res2" || got[3] != "res1" {
+		t.Errorf("wrong hook order: %v", got)
+	}
+
+	req, _ = NewGetRequest("http://cache.com/")
+	if res, err := downloader.Download(req); err != nil || res != cached || fake.hits.Get() != 1 {
+		t.Error("middleware should short-circuit with cached response")
+	}
+
+	req, _ = NewGetRequest("http://drop.com/")
+	if _, err := downloader.Download(req); err != ErrDropRequest {
+		t.Error("middleware should drop request")
+	}
+
+	req, _ = NewGetRequest("http://moved.com/")
+	if _, err := downloader.Download(req); err == nil {
+		t.Error("middleware should reschedule request")
+	} else if rs, ok := err.(*Reschedule); !ok || rs.Request.URL.Host != "new.com" {
+		t.Error("reschedule should carry new request")
+	}
+
+	req, _ = NewGetRequest("http://a.com/fail")
+	if res, err := downloader.Download(req); err != nil || res != cached {
+		t.Error("middleware should recover from download error")
+	}
+}
+
+func TestAnalyzerChain(t *testing.T) {
+	parser := func(res *Response) ([]Data, error) {
+		if res.Request.URL.Path == "/fail" {
+			return nil, ErrParse
+		}
+		in, _ := NewGetRequest("http://www.a.com/child")
+		out, _ := NewGetRequest("http://b.com/child")
+		big := Item{"body": "0123456789012345678901234567890123456789"}
+		return []Data{in, out, big, Item{"ok": 1}}, nil
+	}
+
+	handler := &spiderHook{err: func(res *Response, err error) ([]Data, error) {
+		return Item{"fail": res.Request.URL.String()}.DataList(), nil
+	}}
+
+	analyzer, err := NewAnalyzerSolo(parser,
+		handler,
+		NewOffsiteMiddleware("a.com"),
+		NewDepthMiddleware(1),
+		RefererMiddleware{},
+		NewItemSizeMiddleware(32),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	res := FakeResponse("http://a.com/", "")
+	data, err := analyzer.Analyze(res)
+	if err != nil || len(data) != 2 {
+		t.Fatalf("expect one request and one item, got %v %v", data, err)
+	}
+	child := data[0].(*Request)
+	if child.URL.Host != "www.a.com" {
+		t.Error("offsite request should be dropped")
+	}
+	if child.Meta[KeyDepth] != 1 {
+		t.Error("depth should be set on child request")
+	}
+	if child.Header.Get("Referer") != "http://a.com/" {
+		t.Error("referer should be set on child request")
+	}
+
+	// child of depth 1 yield requests of depth 2
+	data, _ = analyzer.Analyze(&Response{Response: res.Response, Request: child})
+	for _, datum := range data {
+		if _, ok := datum.(*Request); ok {
+			t.Error("request exceed max depth should be dropped")
+		}
+	}
+
+	data, err = analyzer.Analyze(FakeResponse("http://a.com/fail", ""))
+	if err != nil || len(data) != 1 || data[0].(Item)["fail"] != "http://a.com/fail" {
+		t.Errorf("middleware should handle parse error, got %v %v", data, err)
+	}
+}
+
+func TestAnalyzerChainErrback(t *testing.T) {
+	errback := func(req *Request, err error) ([]Data, error) {
+		mirror, _ := NewGetRequest("http://mirror.a.com/page")
+		out, _ := NewGetRequest("http://b.com/page")
+		return []Data{mirror, out}, nil
+	}
+	analyzer, _ := NewAnalyzerErrback(ParserMap{KeyDefault: BodyReader},
+		ErrbackMap{"retry": errback},
+		NewOffsiteMiddleware("a.com"),
+		NewDepthMiddleware(2),
+	)
+	ea := analyzer.(ErrbackAnalyzer)
+
+	req, _ := NewGetRequest("http://a.com/page")
+	data, err := ea.HandleError(req.SetErrback("retry"), ErrDownloadFail)
+	if err != nil || len(data) != 1 {
+		t.Fatalf("offsite request from errback should be dropped, got %v %v", data, err)
+	}
+	if data[0].(*Request).Meta[KeyDepth] != 1 {
+		t.Error("depth should be set on request from errback")
+	}
+
+	// too deep requests from errback are dropped as well
+	req.Meta[KeyDepth] = 2
+	if data, _ := ea.HandleError(req, ErrDownloadFail); len(data) != 0 {
+		t.Errorf("request exceed max depth should be dropped, got %v", data)
+	}
+}
+
+// spiderHook implement SpiderMiddleware with error hook
+type spiderHook struct {
+	NopSpiderMiddleware
+	err func(res *Response, err error) ([]Data, error)
+}
+
+func (self *spiderHook) ProcessError(res *Response, err error) ([]Data, error) {
+	return self.err(res, err)
+}
+
+func TestDownloaderChainReplace(t *testing.T) {
+	var bodies []*closeCheckBody
+	fake := downloaderFunc(func(req *Request) (*Response, error) {
+		res := FakeResponse(req.URL.String(), "origin")
+		body := &closeCheckBody{FakeBody("origin"), NewCounter()}
+		bodies = append(bodies, body)
+		res.Response.Body = body
+		return res, nil
+	})
+	downloader := NewDownloaderChain(fake, &hookMiddleware{
+		response: func(req *Request, res *Response) (Data, error) {
+			switch req.URL.Host {
+			case "replace.com":
+				return FakeResponse(req.URL.String(), "new"), nil
+			case "moved.com":
+				r, _ := NewGetRequest("http://new.com/")
+				return r, nil
+			case "same.com":
+				return res, nil
+			}
+			return nil, nil
+		},
+	})
+
+	for _, host := range []string{"replace.com", "moved.com"} {
+		req, _ := NewGetRequest("http://" + host + "/")
+		downloader.Download(req)
+		if bodies[len(bodies)-1].closed.Get() != 1 {
+			t.Errorf("response replaced on %s should be closed", host)
+		}
+	}
+	req, _ := NewGetRequest("http://same.com/")
+	if res, err := downloader.Download(req); err != nil || bodies[len(bodies)-1].closed.Get() != 0 {
+		t.Error("response returned again should not be closed")
+	} else if body, _ := res.Body(); string(body) != "origin" {
+		t.Errorf("response returned again should be kept, got %q", body)
+	}
+}
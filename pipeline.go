@@ -1,5 +1,7 @@
 package gospider
 
+import "context"
+
 /**************************************************************
 * interface: processor
 **************************************************************/
@@ -18,6 +20,24 @@ type Pipeline interface {
 	Send(item Item) []error
 }
 
+// ContextPipeline is pipeline that could be cancelled by context
+type ContextPipeline interface {
+	Pipeline
+	SendContext(ctx context.Context, item Item) []error
+}
+
+// SendContext adapts any Pipeline to context-carrying version
+// item is not sent if ctx is already done
+func SendContext(ctx context.Context, p Pipeline, item Item) []error {
+	if cp, ok := p.(ContextPipeline); ok {
+		return cp.SendContext(ctx, item)
+	}
+	if err := ctx.Err(); err != nil {
+		return []error{err}
+	}
+	return p.Send(item)
+}
+
 /**************************************************************
 * defaultPipeline: Pipeline
 **************************************************************/
@@ -55,9 +75,18 @@ func NewPipelineSolo(processor Processor) (Pipeline) {
 // defaultPipeline_Send will put item into pipeline for handling
 // nil item will not be checked
 func (self *defaultPipeline) Send(item Item) []error {
+	return self.SendContext(context.Background(), item)
+}
+
+// defaultPipeline_SendContext will check ctx before each processor
+func (self *defaultPipeline) SendContext(ctx context.Context, item Item) []error {
 	// normal errors will just be collected together except ErrDropItem
 	var errs []error
 	for _, processor := range self.processors {
+		if err := ctx.Err(); err != nil {
+			errs = append(errs, err)
+			break
+		}
 		err := processor(item)
 		if err != nil {
 			errs = append(errs, err)
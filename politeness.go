@@ -0,0 +1,208 @@
+package gospider
+
+import (
+	"math/rand"
+	"strings"
+	"sync"
+	"time"
+)
+
+/**************************************************************
+* struct: HostPolicy
+**************************************************************/
+
+// HostPolicy limits request rate toward a single host
+type HostPolicy struct {
+	// Concurrency is max concurrent requests per host. zero means unlimited
+	Concurrency int
+
+	// Delay is minimum interval between two requests to same host
+	Delay time.Duration
+
+	// Jitter adds a random extra delay in [0, Jitter) each time
+	Jitter time.Duration
+}
+
+// HostPolicy_IsZero tells whether policy imposes no limit at all
+func (p HostPolicy) IsZero() bool {
+	return p.Concurrency <= 0 && p.Delay <= 0 && p.Jitter <= 0
+}
+
+/**************************************************************
+* interface: HostDelayer
+**************************************************************/
+
+// HostDelayer provides minimum delay of host learned at runtime, e.g. Crawl-delay
+type HostDelayer interface {
+	// HostDelay returns min delay toward host, zero if there is none
+	HostDelay(host string) time.Duration
+}
+
+// hostDelayers collect HostDelayer from downloader and its middlewares
+func hostDelayers(d Downloader) (list []HostDelayer) {
+	if c, ok := d.(*chainDownloader); ok {
+		for _, m := range c.middlewares {
+			if hd, ok := m.(HostDelayer); ok {
+				list = append(list, hd)
+			}
+		}
+		d = c.Downloader
+	}
+	if hd, ok := d.(HostDelayer); ok {
+		list = append(list, hd)
+	}
+	return
+}
+
+/**************************************************************
+* struct: hostLimiter
+**************************************************************/
+
+// hostSlot holds politeness state of a host
+type hostSlot struct {
+	HostPolicy
+	// limit bounds concurrency adjusted by auto throttle. zero means no bound
+	limit  int
+	active int
+	next   time.Time
+	timer  *time.Timer
+}
+
+// hostLimiter arrange download slots for each host
+type hostLimiter struct {
+	lock     sync.Mutex
+	policy   HostPolicy
+	policies map[string]HostPolicy
+	slots    map[string]*hostSlot
+	throttle *AutoThrottle
+	delayers []HostDelayer
+	// wake is called when a slot may become free
+	wake func()
+}
+
+// newHostLimiter create a limiter with default policy and per host overrides
+// throttle could be nil to disable adaptive delay. delayers raise host delay at runtime
+// return nil if no limit is imposed
+func newHostLimiter(policy HostPolicy, policies map[string]HostPolicy, throttle *AutoThrottle, delayers []HostDelayer, wake func()) *hostLimiter {
+	if policy.IsZero() && len(policies) == 0 && throttle == nil && len(delayers) == 0 {
+		return nil
+	}
+	hosts := make(map[string]HostPolicy, len(policies))
+	for host, p := range policies {
+		hosts[strings.ToLower(host)] = p
+	}
+	return &hostLimiter{
+		policy:   policy,
+		policies: hosts,
+		slots:    make(map[string]*hostSlot),
+		throttle: throttle,
+		delayers: delayers,
+		wake:     wake,
+	}
+}
+
+// requestHost returns host key used for politeness
+func requestHost(req *Request) string {
+	if req == nil || req.URL == nil {
+		return ""
+	}
+	return strings.ToLower(req.URL.Host)
+}
+
+// hostLimiter_slot find or create slot for host. caller must hold lock
+func (self *hostLimiter) slot(host string) *hostSlot {
+	s, ok := self.slots[host]
+	if !ok {
+		policy, ok := self.policies[host]
+		if !ok {
+			policy = self.policy
+		}
+		s = &hostSlot{HostPolicy: policy}
+		if self.throttle != nil {
+			self.throttle.init(s)
+		}
+		self.slots[host] = s
+	}
+	return s
+}
+
+// hostLimiter_TryAcquire take a slot for request if its host is free
+// when host is delayed, wake is scheduled at the time it becomes free
+func (self *hostLimiter) TryAcquire(req *Request) bool {
+	_, ok := self.acquire(req)
+	return ok
+}
+
+// hostLimiter_Acquire will block until slot acquired or quit is closed
+func (self *hostLimiter) Acquire(req *Request, quit <-chan struct{}) bool {
+	for {
+		wait, ok := self.acquire(req)
+		if ok {
+			return true
+		}
+		if wait <= 0 {
+			// waiting for concurrency slot, poll
+			wait = 10 * time.Millisecond
+		}
+		select {
+		case <-time.After(wait):
+		case <-quit:
+			return false
+		}
+	}
+}
+
+// hostLimiter_acquire returns time to wait if slot is not available
+func (self *hostLimiter) acquire(req *Request) (time.Duration, bool) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	s := self.slot(requestHost(req))
+
+	if s.Concurrency > 0 && s.active >= s.Concurrency {
+		return 0, false
+	}
+
+	now := time.Now()
+	if wait := s.next.Sub(now); wait > 0 {
+		if s.timer == nil && self.wake != nil {
+			s.timer = time.AfterFunc(wait, func() {
+				self.lock.Lock()
+				s.timer = nil
+				self.lock.Unlock()
+				self.wake()
+			})
+		}
+		return wait, false
+	}
+
+	s.active++
+	delay := s.Delay
+	for _, hd := range self.delayers {
+		if d := hd.HostDelay(requestHost(req)); d > delay {
+			delay = d
+		}
+	}
+	if s.Jitter > 0 {
+		delay += time.Duration(rand.Int63n(int64(s.Jitter)))
+	}
+	s.next = now.Add(delay)
+	return 0, true
+}
+
+// hostLimiter_Release return slot taken by request
+// latency & res of download are fed to auto throttle if enabled
+func (self *hostLimiter) Release(req *Request, latency time.Duration, res *Response) {
+	self.lock.Lock()
+	if s, ok := self.slots[requestHost(req)]; ok {
+		if s.active > 0 {
+			s.active--
+		}
+		if self.throttle != nil {
+			self.throttle.adjust(s, latency, res, time.Now())
+		}
+	}
+	self.lock.Unlock()
+	if self.wake != nil {
+		self.wake()
+	}
+}
@@ -0,0 +1,73 @@
+package gospider
+
+import (
+	"testing"
+	"time"
+)
+
+func TestHostLimiter(t *testing.T) {
+	limiter := newHostLimiter(
+		HostPolicy{Concurrency: 1},
+		map[string]HostPolicy{"slow.com": {Delay: 50 * time.Millisecond}},
+		nil, nil, nil,
+	)
+
+	a1, _ := NewGetRequest("http://a.com/1")
+	a2, _ := NewGetRequest("http://a.com/2")
+	b1, _ := NewGetRequest("http://b.com/1")
+	if !limiter.TryAcquire(a1) {
+		t.Error("free host should be acquired")
+	}
+	if limiter.TryAcquire(a2) {
+		t.Error("host should not exceed concurrency")
+	}
+	if !limiter.TryAcquire(b1) {
+		t.Error("busy host should not block other hosts")
+	}
+	limiter.Release(a1, 0, nil)
+	if !limiter.TryAcquire(a2) {
+		t.Error("host should be acquired after release")
+	}
+
+	s1, _ := NewGetRequest("http://slow.com/1")
+	s2, _ := NewGetRequest("http://slow.com/2")
+	if !limiter.TryAcquire(s1) {
+		t.Error("free host should be acquired")
+	}
+	limiter.Release(s1, 0, nil)
+	if limiter.TryAcquire(s2) {
+		t.Error("second request should be delayed")
+	}
+	start := time.Now()
+	if !limiter.Acquire(s2, nil) {
+		t.Error("acquire should success after delay")
+	}
+	if time.Since(start) < 40*time.Millisecond {
+		t.Error("acquire should wait for delay")
+	}
+}
+
+func TestPriorityQueuePopFunc(t *testing.T) {
+	q := NewPriorityQueue(10).(SelectiveQueue)
+	busy, _ := NewGetRequest("http://busy.com/")
+	free, _ := NewGetRequest("http://free.com/")
+	q.Push(busy.SetPriority(10))
+	q.Push(free)
+
+	accept := func(req *Request) bool { return requestHost(req) != "busy.com" }
+	if req := q.PopFunc(accept); req != free {
+		t.Error("pop func should skip request not accepted")
+	}
+
+	popped := make(chan *Request)
+	go func() { popped <- q.PopFunc(accept) }()
+	select {
+	case <-popped:
+		t.Error("pop func should block when no request accepted")
+	case <-time.After(10 * time.Millisecond):
+	}
+	q.Close()
+	if <-popped != nil {
+		t.Error("pop func should return nil when queue closed")
+	}
+}
@@ -0,0 +1,317 @@
+package gospider
+
+import (
+	"context"
+	"errors"
+	"math/rand"
+	"net/url"
+	"sync"
+	"time"
+	log "github.com/Sirupsen/logrus"
+)
+
+/**************************************************************
+* struct: ProxyPool
+**************************************************************/
+
+// parseProxyURL parse proxy url with scheme http, https or socks5
+func parseProxyURL(proxy string) (*url.URL, error) {
+	u, err := url.Parse(proxy)
+	if err != nil || u.Host == "" {
+		return nil, ErrInvalidProxy
+	}
+	switch u.Scheme {
+	case "http", "https", "socks5":
+		return u, nil
+	}
+	return nil, ErrInvalidProxy
+}
+
+// ProxyStrategy decides which proxy is picked for a request
+type ProxyStrategy int
+
+const (
+	// ProxyRoundRobin picks available proxies in turn
+	ProxyRoundRobin ProxyStrategy = iota
+	// ProxyRandom picks available proxies randomly, weighted by health score
+	ProxyRandom
+	// ProxySticky binds each host to one proxy until it is banned
+	ProxySticky
+)
+
+// Default health settings of proxy pool
+var (
+	DefaultProxyMaxFailures = 3
+	DefaultProxyCooldown    = 5 * time.Minute
+)
+
+// proxyScoreAlpha is weight of latest result in health score
+const proxyScoreAlpha = 0.2
+
+// ProxyStats is health state of a proxy
+type ProxyStats struct {
+	URL     string  `json:"url"`
+	Score   float64 `json:"score"`
+	Success int64   `json:"success"`
+	Failure int64   `json:"failure"`
+	Banned  bool    `json:"banned"`
+}
+
+// proxyState holds health state of a proxy
+type proxyState struct {
+	ProxyStats
+	failures    int
+	bannedUntil time.Time
+}
+
+// ProxyPool manages a set of proxies with health scoring
+// a proxy is banned for Cooldown after MaxFailures consecutive failures
+type ProxyPool struct {
+	Strategy    ProxyStrategy
+	MaxFailures int
+	Cooldown    time.Duration
+
+	lock    sync.Mutex
+	proxies []*proxyState
+	index   map[string]*proxyState
+	sticky  map[string]*proxyState
+	next    int
+	rand    *rand.Rand
+	now     func() time.Time
+}
+
+// NewProxyPool create a proxy pool with given strategy and proxy urls
+// proxy url scheme should be http, https or socks5
+func NewProxyPool(strategy ProxyStrategy, proxies ...string) (*ProxyPool, error) {
+	pool := &ProxyPool{
+		Strategy:    strategy,
+		MaxFailures: DefaultProxyMaxFailures,
+		Cooldown:    DefaultProxyCooldown,
+		index:       make(map[string]*proxyState),
+		sticky:      make(map[string]*proxyState),
+		rand:        rand.New(rand.NewSource(time.Now().UnixNano())),
+		now:         time.Now,
+	}
+	for _, proxy := range proxies {
+		if err := pool.Add(proxy); err != nil {
+			return nil, err
+		}
+	}
+	return pool, nil
+}
+
+// ProxyPool_Add put a new proxy into pool
+func (self *ProxyPool) Add(proxy string) error {
+	if _, err := parseProxyURL(proxy); err != nil {
+		return err
+	}
+
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	if _, ok := self.index[proxy]; !ok {
+		p := &proxyState{ProxyStats: ProxyStats{URL: proxy, Score: 1}}
+		self.proxies = append(self.proxies, p)
+		self.index[proxy] = p
+	}
+	return nil
+}
+
+// ProxyPool_Has tells whether proxy belongs to pool
+func (self *ProxyPool) Has(proxy string) bool {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	_, ok := self.index[proxy]
+	return ok
+}
+
+// ProxyPool_Get picks a proxy for host. ErrNoProxy if all of them are banned
+func (self *ProxyPool) Get(host string) (string, error) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	now := self.now()
+
+	var p *proxyState
+	switch self.Strategy {
+	case ProxyRandom:
+		p = self.pickRandom(now)
+	case ProxySticky:
+		if p = self.sticky[host]; p == nil || !self.available(p, now) {
+			if p = self.pickBest(now); p != nil {
+				self.sticky[host] = p
+			}
+		}
+	default:
+		p = self.pickNext(now)
+	}
+	if p == nil {
+		return "", ErrNoProxy
+	}
+	return p.URL, nil
+}
+
+// ProxyPool_Report feed result of a request through proxy into health score
+// proxy not in pool is ignored
+func (self *ProxyPool) Report(proxy string, ok bool) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	p, exist := self.index[proxy]
+	if !exist {
+		return
+	}
+
+	result := 0.0
+	if ok {
+		result = 1
+		p.Success++
+		p.failures = 0
+	} else {
+		p.Failure++
+		p.failures++
+	}
+	p.Score = (1-proxyScoreAlpha)*p.Score + proxyScoreAlpha*result
+
+	if !ok && !p.Banned && self.MaxFailures > 0 && p.failures >= self.MaxFailures {
+		p.Banned = true
+		p.bannedUntil = self.now().Add(self.Cooldown)
+		log.Warnf("[DOWN] proxy %s banned for %s after %d failures", proxy, self.Cooldown, p.failures)
+	}
+}
+
+// ProxyPool_Stats returns health state of all proxies
+func (self *ProxyPool) Stats() []ProxyStats {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	now := self.now()
+	stats := make([]ProxyStats, len(self.proxies))
+	for i, p := range self.proxies {
+		self.available(p, now)
+		stats[i] = p.ProxyStats
+	}
+	return stats
+}
+
+// ProxyPool_available tells whether proxy could be used, unban it after cooldown
+// unbanned proxy starts with a medium score. caller must hold lock
+func (self *ProxyPool) available(p *proxyState, now time.Time) bool {
+	if p.Banned && !now.Before(p.bannedUntil) {
+		p.Banned = false
+		p.failures = 0
+		p.Score = 0.5
+		log.Infof("[DOWN] proxy %s unbanned", p.URL)
+	}
+	return !p.Banned
+}
+
+// ProxyPool_pickNext picks next available proxy in turn
+func (self *ProxyPool) pickNext(now time.Time) *proxyState {
+	for i := 0; i < len(self.proxies); i++ {
+		p := self.proxies[(self.next+i)%len(self.proxies)]
+		if self.available(p, now) {
+			self.next = (self.next + i + 1) % len(self.proxies)
+			return p
+		}
+	}
+	return nil
+}
+
+// ProxyPool_pickRandom picks available proxy with probability proportional to score
+func (self *ProxyPool) pickRandom(now time.Time) *proxyState {
+	var list []*proxyState
+	total := 0.0
+	for _, p := range self.proxies {
+		if self.available(p, now) {
+			list = append(list, p)
+			total += proxyWeight(p)
+		}
+	}
+	x := self.rand.Float64() * total
+	for _, p := range list {
+		if x -= proxyWeight(p); x < 0 {
+			return p
+		}
+	}
+	if len(list) > 0 {
+		return list[len(list)-1]
+	}
+	return nil
+}
+
+// ProxyPool_pickBest picks available proxy with highest score
+func (self *ProxyPool) pickBest(now time.Time) (best *proxyState) {
+	for _, p := range self.proxies {
+		if self.available(p, now) && (best == nil || p.Score > best.Score) {
+			best = p
+		}
+	}
+	return
+}
+
+// proxyWeight keep a floor so that unhealthy proxies still get a chance
+func proxyWeight(p *proxyState) float64 {
+	if p.Score < 0.05 {
+		return 0.05
+	}
+	return p.Score
+}
+
+/**************************************************************
+* DownloaderMiddleware: proxy
+**************************************************************/
+
+// DefaultProxyFailureCodes are statuses that count as failure of proxy
+var DefaultProxyFailureCodes = []int{403, 407, 429, 502, 503, 504}
+
+// proxyMiddleware set Meta[KeyProxy] from pool and reports results back
+type proxyMiddleware struct {
+	pool         *ProxyPool
+	failureCodes []int
+}
+
+// NewProxyMiddleware assigns proxy from pool to each request
+// proxy set in Meta[KeyProxy] by user (not from pool) is kept as is
+func NewProxyMiddleware(pool *ProxyPool) DownloaderMiddleware {
+	return &proxyMiddleware{pool: pool, failureCodes: DefaultProxyFailureCodes}
+}
+
+func (self *proxyMiddleware) ProcessRequest(req *Request) (Data, error) {
+	if proxy, ok := req.Meta[KeyProxy].(string); ok && proxy != "" {
+		if !self.pool.Has(proxy) {
+			return nil, nil
+		}
+		// assigned by pool on last attempt, pick again
+		delete(req.Meta, KeyProxy)
+	}
+	proxy, err := self.pool.Get(requestHost(req))
+	if err != nil {
+		return nil, err
+	}
+	if req.Meta == nil {
+		req.Meta = make(MetaMap, 1)
+	}
+	req.Meta[KeyProxy] = proxy
+	return nil, nil
+}
+
+func (self *proxyMiddleware) ProcessResponse(req *Request, res *Response) (Data, error) {
+	if proxy, ok := req.Meta[KeyProxy].(string); ok && res != nil && res.Response != nil {
+		failed := false
+		for _, code := range self.failureCodes {
+			if res.StatusCode == code {
+				failed = true
+				break
+			}
+		}
+		self.pool.Report(proxy, !failed)
+	}
+	return nil, nil
+}
+
+func (self *proxyMiddleware) ProcessError(req *Request, err error) (Data, error) {
+	if err == ErrNoProxy || errors.Is(err, ErrDropRequest) || errors.Is(err, context.Canceled) {
+		return nil, nil
+	}
+	if proxy, ok := req.Meta[KeyProxy].(string); ok {
+		self.pool.Report(proxy, false)
+	}
+	return nil, nil
+}
@@ -0,0 +1,257 @@
+package gospider
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestProxyPool(t *testing.T) {
+	pool, err := NewProxyPool(ProxyRoundRobin, "http://a:1", "http://b:1", "socks5://c:1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+	pool.now = func() time.Time { return now }
+
+	for _, want := range []string{"http://a:1", "http://b:1", "socks5://c:1", "http://a:1"} {
+		if got, _ := pool.Get("x.com"); got != want {
+			t.Errorf("round robin should pick %s, got %s", want, got)
+		}
+	}
+
+	// b is banned after consecutive failures
+	for i := 0; i < DefaultProxyMaxFailures; i++ {
+		pool.Report("http://b:1", false)
+	}
+	for i := 0; i < 6; i++ {
+		if got, _ := pool.Get("x.com"); got == "http://b:1" {
+			t.Error("banned proxy should not be picked")
+		}
+	}
+
+	// sticky keeps host on same proxy until it is banned
+	pool.Strategy = ProxySticky
+	first, _ := pool.Get("x.com")
+	for i := 0; i < 3; i++ {
+		if got, _ := pool.Get("x.com"); got != first {
+			t.Errorf("sticky proxy changed from %s to %s", first, got)
+		}
+	}
+	for i := 0; i < DefaultProxyMaxFailures; i++ {
+		pool.Report(first, false)
+	}
+	if got, _ := pool.Get("x.com"); got == first || got == "http://b:1" {
+		t.Errorf("sticky host should move to a healthy proxy, got %s", got)
+	}
+	remain, _ := pool.Get("x.com")
+	for i := 0; i < DefaultProxyMaxFailures; i++ {
+		pool.Report(remain, false)
+	}
+	if _, err := pool.Get("x.com"); err != ErrNoProxy {
+		t.Error("all banned proxies should give ErrNoProxy")
+	}
+
+	// unbanned after cooldown
+	now = now.Add(DefaultProxyCooldown)
+	if _, err := pool.Get("x.com"); err != nil {
+		t.Error("proxies should be unbanned after cooldown")
+	}
+	for _, s := range pool.Stats() {
+		if s.Banned || s.Score != 0.5 {
+			t.Errorf("unbanned proxy should start with medium score: %+v", s)
+		}
+	}
+
+	if _, err := NewProxyPool(ProxyRandom, "ftp://a:1"); err != ErrInvalidProxy {
+		t.Error("unsupported proxy scheme should be rejected")
+	}
+}
+
+func TestProxyPoolRandom(t *testing.T) {
+	pool, _ := NewProxyPool(ProxyRandom, "http://good:1", "http://bad:1")
+	pool.MaxFailures = 0
+	for i := 0; i < 20; i++ {
+		pool.Report("http://bad:1", false)
+	}
+	count := map[string]int{}
+	for i := 0; i < 1000; i++ {
+		p, _ := pool.Get("x.com")
+		count[p]++
+	}
+	if count["http://bad:1"] == 0 || count["http://bad:1"] > 200 {
+		t.Errorf("random pick should be weighted by score: %v", count)
+	}
+}
+
+// newTestHTTPProxy serves plain http proxy requests and CONNECT tunnels
+func newTestHTTPProxy(t *testing.T, used Counter) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		used.Inc()
+		if r.Method == http.MethodConnect {
+			upstream, err := net.Dial("tcp", r.Host)
+			if err != nil {
+				w.WriteHeader(http.StatusBadGateway)
+				return
+			}
+			w.WriteHeader(http.StatusOK)
+			conn, _, _ := w.(http.Hijacker).Hijack()
+			go func() { io.Copy(upstream, conn); upstream.Close() }()
+			io.Copy(conn, upstream)
+			conn.Close()
+			return
+		}
+		res, err := http.DefaultTransport.RoundTrip(r)
+		if err != nil {
+			w.WriteHeader(http.StatusBadGateway)
+			return
+		}
+		defer res.Body.Close()
+		w.WriteHeader(res.StatusCode)
+		io.Copy(w, res.Body)
+	}))
+}
+
+// newTestSocks5 serves socks5 CONNECT without authentication
+func newTestSocks5(t *testing.T, used Counter) net.Listener {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			used.Inc()
+			go func(conn net.Conn) {
+				defer conn.Close()
+				buf := make([]byte, 262)
+				// greeting: ver, nmethods, methods
+				if _, err := io.ReadFull(conn, buf[:2]); err != nil {
+					return
+				}
+				io.ReadFull(conn, buf[:buf[1]])
+				conn.Write([]byte{5, 0})
+				// request: ver, cmd, rsv, atyp, addr, port
+				io.ReadFull(conn, buf[:4])
+				var host string
+				switch buf[3] {
+				case 1:
+					io.ReadFull(conn, buf[:4])
+					host = net.IP(buf[:4]).String()
+				case 3:
+					io.ReadFull(conn, buf[:1])
+					n := buf[0]
+					io.ReadFull(conn, buf[:n])
+					host = string(buf[:n])
+				default:
+					return
+				}
+				io.ReadFull(conn, buf[:2])
+				port := binary.BigEndian.Uint16(buf[:2])
+				upstream, err := net.Dial("tcp", net.JoinHostPort(host, strconv.Itoa(int(port))))
+				if err != nil {
+					conn.Write([]byte{5, 1, 0, 1, 0, 0, 0, 0, 0, 0})
+					return
+				}
+				defer upstream.Close()
+				conn.Write([]byte{5, 0, 0, 1, 0, 0, 0, 0, 0, 0})
+				go io.Copy(upstream, conn)
+				io.Copy(conn, upstream)
+			}(conn)
+		}
+	}()
+	return l
+}
+
+func TestDownloaderProxy(t *testing.T) {
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "hello")
+	})
+	target := httptest.NewServer(handler)
+	defer target.Close()
+	tlsTarget := httptest.NewTLSServer(handler)
+	defer tlsTarget.Close()
+
+	httpUsed, socksUsed := NewCounter(), NewCounter()
+	httpProxy := newTestHTTPProxy(t, httpUsed)
+	defer httpProxy.Close()
+	socks := newTestSocks5(t, socksUsed)
+	defer socks.Close()
+
+	// client trusts tls target, proxy transports are cloned from it
+	downloader, _ := NewDownloader(tlsTarget.Client())
+	fetch := func(u, proxy string) {
+		req, _ := NewRequest("GET", u, nil, MetaMap{KeyProxy: proxy})
+		res, err := downloader.Download(req)
+		if err != nil {
+			t.Fatalf("download %s via %s failed: %s", u, proxy, err)
+		}
+		body, _ := res.Body()
+		if string(body) != "hello" {
+			t.Errorf("wrong body via %s: %s", proxy, body)
+		}
+	}
+
+	fetch(target.URL, httpProxy.URL)
+	fetch(tlsTarget.URL, httpProxy.URL)
+	if httpUsed.Get() != 2 {
+		t.Errorf("http proxy should be used for http & https (CONNECT), used %d", httpUsed.Get())
+	}
+	fetch(target.URL, "socks5://"+socks.Addr().String())
+	if socksUsed.Get() != 1 {
+		t.Errorf("socks5 proxy should be used, used %d", socksUsed.Get())
+	}
+
+	req, _ := NewRequest("GET", target.URL, nil, MetaMap{KeyProxy: "ftp://x"})
+	if _, err := downloader.Download(req); err != ErrInvalidProxy {
+		t.Errorf("invalid proxy should be reported, got %v", err)
+	}
+}
+
+func TestProxyMiddleware(t *testing.T) {
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "hello")
+	}))
+	defer target.Close()
+	good := newTestHTTPProxy(t, NewCounter())
+	defer good.Close()
+	// nothing listens on a closed server
+	dead := httptest.NewServer(http.NotFoundHandler())
+	dead.Close()
+
+	pool, _ := NewProxyPool(ProxyRoundRobin, dead.URL, good.URL)
+	base, _ := NewDownloader(nil)
+	downloader := NewDownloaderChain(base, NewProxyMiddleware(pool))
+
+	ok := 0
+	for i := 0; i < 8; i++ {
+		req, _ := NewGetRequest(target.URL)
+		if _, err := downloader.Download(req); err == nil {
+			ok++
+		}
+	}
+	// dead proxy is banned after 3 failures, then all requests go through good one
+	if ok != 5 {
+		t.Errorf("dead proxy should be banned, %d requests ok", ok)
+	}
+	for _, s := range pool.Stats() {
+		if s.URL == dead.URL && (!s.Banned || s.Failure != 3) {
+			t.Errorf("dead proxy should be banned: %+v", s)
+		}
+	}
+
+	// proxy set by user is kept
+	req, _ := NewRequest("GET", target.URL, nil, MetaMap{KeyProxy: good.URL + "/"})
+	if _, err := downloader.Download(req); err != nil || req.Meta[KeyProxy] != good.URL+"/" {
+		t.Error("user proxy should be kept")
+	}
+}
@@ -0,0 +1,486 @@
+package gospider
+
+import (
+	"container/heap"
+	"sync"
+)
+
+/**************************************************************
+* interface: RequestQueue
+**************************************************************/
+
+// RequestQueue is the request frontier of scheduler
+type RequestQueue interface {
+	// Push will block when queue is full. return false if queue is closed
+	Push(req *Request) bool
+	// Pop will block when queue is empty. return nil if queue is closed
+	Pop() *Request
+	Len() int
+	// Close will wake up all blocking Push & Pop
+	Close()
+	// Drain will take all remaining requests out of queue
+	Drain() []*Request
+}
+
+// SelectiveQueue is RequestQueue which could skip requests not ready yet
+type SelectiveQueue interface {
+	RequestQueue
+	// PopFunc will try requests in priority order and pop first one accepted
+	// block until there is one. return nil if queue is closed
+	// accept must not call methods of queue. it should decide by host of
+	// request, since other requests of a rejected host may be skipped
+	PopFunc(accept func(req *Request) bool) *Request
+	// Wake will make blocking PopFunc re-check requests
+	Wake()
+}
+
+// AckQueue is RequestQueue which requires popped request to be acknowledged
+// once handled. requests popped but not acknowledged are requeued on recovery
+type AckQueue interface {
+	RequestQueue
+	Ack(req *Request)
+}
+
+// SharedQueue is RequestQueue shared by multiple engines
+// engine using it never stops itself, since others may still yield requests
+type SharedQueue interface {
+	RequestQueue
+	Shared()
+}
+
+// leaseQueue is queue which takes popped requests not acknowledged back on Drain
+// engine leaves such requests out of pending data, so they are crawled once
+type leaseQueue interface {
+	leased(req *Request) bool
+}
+
+/**************************************************************
+* struct: priorityQueue
+**************************************************************/
+
+// priorityQueue is a heap backed RequestQueue
+// request with higher priority pops first, FIFO among equal priorities
+// requests are grouped by host, each host keeps its own heap, and hosts are
+// ordered by their best request. so selective pop only tries head of each host
+type priorityQueue struct {
+	lock     sync.Mutex
+	notEmpty *sync.Cond
+	notFull  *sync.Cond
+	hosts    hostHeap
+	index    map[string]*hostQueue
+	size     int
+	capacity int
+	seq      uint64
+	closed   bool
+}
+
+// NewPriorityQueue create a bounded priority queue
+// capacity less than 1 is treated as 1
+func NewPriorityQueue(capacity int) RequestQueue {
+	if capacity < 1 {
+		capacity = 1
+	}
+	q := &priorityQueue{capacity: capacity, index: make(map[string]*hostQueue)}
+	q.notEmpty = sync.NewCond(&q.lock)
+	q.notFull = sync.NewCond(&q.lock)
+	return q
+}
+
+func (self *priorityQueue) Push(req *Request) bool {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	for !self.closed && self.size >= self.capacity {
+		self.notFull.Wait()
+	}
+	if self.closed {
+		return false
+	}
+	self.seq++
+	self.push(queueEntry{req, self.seq})
+	// selective pop may reject new request, so wake up all of them
+	self.notEmpty.Broadcast()
+	return true
+}
+
+// priorityQueue_restore push request with given sequence regardless of capacity
+func (self *priorityQueue) restore(req *Request, seq uint64) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	if seq > self.seq {
+		self.seq = seq
+	}
+	self.push(queueEntry{req, seq})
+	self.notEmpty.Broadcast()
+}
+
+// priorityQueue_push put entry into heap of its host. caller must hold lock
+func (self *priorityQueue) push(entry queueEntry) {
+	host := requestHost(entry.req)
+	if hq, ok := self.index[host]; ok {
+		heap.Push(&hq.heap, entry)
+		heap.Fix(&self.hosts, hq.index)
+	} else {
+		hq = &hostQueue{host: host, heap: requestHeap{entry}}
+		self.index[host] = hq
+		heap.Push(&self.hosts, hq)
+	}
+	self.size++
+}
+
+// priorityQueue_pop take best request of host. caller must hold lock
+func (self *priorityQueue) pop(hq *hostQueue) *Request {
+	entry := heap.Pop(&hq.heap).(queueEntry)
+	if len(hq.heap) == 0 {
+		heap.Remove(&self.hosts, hq.index)
+		delete(self.index, hq.host)
+	} else {
+		heap.Fix(&self.hosts, hq.index)
+	}
+	self.size--
+	self.notFull.Signal()
+	return entry.req
+}
+
+func (self *priorityQueue) Pop() *Request {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	for !self.closed && self.size == 0 {
+		self.notEmpty.Wait()
+	}
+	if self.closed {
+		return nil
+	}
+	return self.pop(self.hosts[0])
+}
+
+// priorityQueue_PopFunc walk hosts lazily in order of their best request
+// and stop at first accepted. a host whose best request is rejected is skipped
+func (self *priorityQueue) PopFunc(accept func(req *Request) bool) *Request {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	for !self.closed {
+		if hq := self.hosts.find(accept); hq != nil {
+			return self.pop(hq)
+		}
+		self.notEmpty.Wait()
+	}
+	return nil
+}
+
+func (self *priorityQueue) Wake() {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	self.notEmpty.Broadcast()
+}
+
+func (self *priorityQueue) Len() int {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	return self.size
+}
+
+func (self *priorityQueue) Close() {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	self.closed = true
+	self.notEmpty.Broadcast()
+	self.notFull.Broadcast()
+}
+
+func (self *priorityQueue) Drain() []*Request {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	reqs := make([]*Request, 0, self.size)
+	for self.size > 0 {
+		reqs = append(reqs, self.pop(self.hosts[0]))
+	}
+	self.notFull.Broadcast()
+	return reqs
+}
+
+/**************************************************************
+* struct: requestHeap & hostHeap
+**************************************************************/
+
+// queueEntry holds request with sequence number for FIFO ordering
+type queueEntry struct {
+	req *Request
+	seq uint64
+}
+
+// entryLess tells whether a should pop before b
+func entryLess(a, b queueEntry) bool {
+	if a.req.Priority != b.req.Priority {
+		return a.req.Priority > b.req.Priority
+	}
+	return a.seq < b.seq
+}
+
+// requestHeap implements heap.Interface
+type requestHeap []queueEntry
+
+func (h requestHeap) Len() int {
+	return len(h)
+}
+
+func (h requestHeap) Less(i, j int) bool {
+	return entryLess(h[i], h[j])
+}
+
+func (h requestHeap) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+}
+
+func (h *requestHeap) Push(x interface{}) {
+	*h = append(*h, x.(queueEntry))
+}
+
+func (h *requestHeap) Pop() interface{} {
+	old := *h
+	n := len(old)
+	x := old[n-1]
+	old[n-1] = queueEntry{}
+	*h = old[:n-1]
+	return x
+}
+
+// hostQueue holds requests of a host, index is its position in hostHeap
+type hostQueue struct {
+	host  string
+	heap  requestHeap
+	index int
+}
+
+// hostHeap implements heap.Interface, ordered by best request of each host
+type hostHeap []*hostQueue
+
+func (h hostHeap) Len() int {
+	return len(h)
+}
+
+func (h hostHeap) Less(i, j int) bool {
+	return entryLess(h[i].heap[0], h[j].heap[0])
+}
+
+func (h hostHeap) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].index = i
+	h[j].index = j
+}
+
+func (h *hostHeap) Push(x interface{}) {
+	hq := x.(*hostQueue)
+	hq.index = len(*h)
+	*h = append(*h, hq)
+}
+
+func (h *hostHeap) Pop() interface{} {
+	old := *h
+	n := len(old)
+	x := old[n-1]
+	old[n-1] = nil
+	*h = old[:n-1]
+	return x
+}
+
+// hostHeap_find visit hosts in priority order and returns first one whose best
+// request is accepted. only subtrees of rejected hosts are expanded
+func (h hostHeap) find(accept func(req *Request) bool) *hostQueue {
+	if len(h) == 0 {
+		return nil
+	}
+	frontier := &hostFrontier{hosts: h, nodes: []int{0}}
+	for frontier.Len() > 0 {
+		i := heap.Pop(frontier).(int)
+		if accept(h[i].heap[0].req) {
+			return h[i]
+		}
+		for _, child := range []int{2*i + 1, 2*i + 2} {
+			if child < len(h) {
+				heap.Push(frontier, child)
+			}
+		}
+	}
+	return nil
+}
+
+// hostFrontier is heap of hostHeap positions to be visited, used by find
+type hostFrontier struct {
+	hosts hostHeap
+	nodes []int
+}
+
+func (f *hostFrontier) Len() int {
+	return len(f.nodes)
+}
+
+func (f *hostFrontier) Less(i, j int) bool {
+	return f.hosts.Less(f.nodes[i], f.nodes[j])
+}
+
+func (f *hostFrontier) Swap(i, j int) {
+	f.nodes[i], f.nodes[j] = f.nodes[j], f.nodes[i]
+}
+
+func (f *hostFrontier) Push(x interface{}) {
+	f.nodes = append(f.nodes, x.(int))
+}
+
+func (f *hostFrontier) Pop() interface{} {
+	n := len(f.nodes)
+	x := f.nodes[n-1]
+	f.nodes = f.nodes[:n-1]
+	return x
+}
+
+/**************************************************************
+* struct: prefetchQueue
+**************************************************************/
+
+// queuePrefetch is max requests held in memory by prefetchQueue
+const queuePrefetch = 64
+
+// prefetchQueue makes any RequestQueue selective. a pump goroutine pulls up to
+// size requests into memory, so request of a busy host is held aside while
+// others are popped. head-of-line blocking only comes back if all held
+// requests belong to busy hosts
+type prefetchQueue struct {
+	RequestQueue
+	lock   sync.Mutex
+	cond   *sync.Cond
+	held   []*Request
+	size   int
+	closed bool
+	start  sync.Once
+	// done is closed when pump quits
+	done chan struct{}
+}
+
+// newPrefetchQueue wraps q with at most size requests held in memory
+// the wrapper is a SharedQueue if q is
+func newPrefetchQueue(q RequestQueue, size int) SelectiveQueue {
+	if size < 1 {
+		size = 1
+	}
+	self := &prefetchQueue{RequestQueue: q, size: size, done: make(chan struct{})}
+	self.cond = sync.NewCond(&self.lock)
+	if _, ok := q.(SharedQueue); ok {
+		return sharedPrefetchQueue{self}
+	}
+	return self
+}
+
+// prefetchQueue_pump pull requests from underlying queue while there is room
+// it is started by first pop, and quits when either queue is closed
+func (self *prefetchQueue) pump() {
+	defer close(self.done)
+	for {
+		self.lock.Lock()
+		for !self.closed && len(self.held) >= self.size {
+			self.cond.Wait()
+		}
+		closed := self.closed
+		self.lock.Unlock()
+		if closed {
+			return
+		}
+
+		req := self.RequestQueue.Pop()
+		self.lock.Lock()
+		if req == nil {
+			self.closed = true
+		} else {
+			// request popped after close is kept for Drain
+			self.held = append(self.held, req)
+		}
+		self.cond.Broadcast()
+		self.lock.Unlock()
+		if req == nil {
+			return
+		}
+	}
+}
+
+func (self *prefetchQueue) Pop() *Request {
+	return self.PopFunc(func(*Request) bool { return true })
+}
+
+// prefetchQueue_PopFunc pop first held request accepted, in order they were pulled
+func (self *prefetchQueue) PopFunc(accept func(req *Request) bool) *Request {
+	self.start.Do(func() { go self.pump() })
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	for !self.closed {
+		for i, req := range self.held {
+			if accept(req) {
+				self.held = append(self.held[:i], self.held[i+1:]...)
+				self.cond.Broadcast()
+				return req
+			}
+		}
+		self.cond.Wait()
+	}
+	return nil
+}
+
+func (self *prefetchQueue) Wake() {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	self.cond.Broadcast()
+}
+
+// prefetchQueue_Ack forward to underlying queue if it is an AckQueue
+func (self *prefetchQueue) Ack(req *Request) {
+	if q, ok := self.RequestQueue.(AckQueue); ok {
+		q.Ack(req)
+	}
+}
+
+func (self *prefetchQueue) Len() int {
+	self.lock.Lock()
+	n := len(self.held)
+	self.lock.Unlock()
+	return n + self.RequestQueue.Len()
+}
+
+func (self *prefetchQueue) Close() {
+	self.RequestQueue.Close()
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	self.closed = true
+	self.cond.Broadcast()
+}
+
+// prefetchQueue_Drain returns held requests followed by those of underlying queue
+// queue is closed and pump is waited, so no request is pulled after that
+// held requests taken back by underlying queue are not returned
+func (self *prefetchQueue) Drain() []*Request {
+	self.Close()
+	self.start.Do(func() { close(self.done) })
+	<-self.done
+	self.lock.Lock()
+	held := self.held
+	self.held = nil
+	self.lock.Unlock()
+
+	var reqs []*Request
+	for _, req := range held {
+		if !self.leased(req) {
+			reqs = append(reqs, req)
+		}
+	}
+	return append(reqs, self.RequestQueue.Drain()...)
+}
+
+// prefetchQueue_leased forward to underlying queue if it is a leaseQueue
+func (self *prefetchQueue) leased(req *Request) bool {
+	q, ok := self.RequestQueue.(leaseQueue)
+	return ok && q.leased(req)
+}
+
+// sharedPrefetchQueue is prefetchQueue over a SharedQueue
+type sharedPrefetchQueue struct {
+	*prefetchQueue
+}
+
+func (sharedPrefetchQueue) Shared() {}
@@ -0,0 +1,134 @@
+package gospider
+
+import (
+	"testing"
+	"time"
+)
+
+func TestPriorityQueue(t *testing.T) {
+	q := NewPriorityQueue(10)
+	for i, prior := range []int32{0, 5, 0, 5, 1} {
+		req, _ := NewGetRequest("http://localhost/")
+		req.Meta["i"] = i
+		q.Push(req.SetPriority(prior))
+	}
+
+	// higher priority first, FIFO among equal priorities
+	for _, i := range []int{1, 3, 4, 0, 2} {
+		if req := q.Pop(); req.Meta["i"] != i {
+			t.Errorf("expect request %d, got %v", i, req.Meta["i"])
+		}
+	}
+
+	if q.Len() != 0 {
+		t.Error("queue should be empty")
+	}
+}
+
+func TestPriorityQueueBlock(t *testing.T) {
+	q := NewPriorityQueue(1)
+	req, _ := NewGetRequest("http://localhost/")
+	q.Push(req)
+
+	pushed := make(chan bool)
+	go func() { pushed <- q.Push(req) }()
+	select {
+	case <-pushed:
+		t.Error("push should block when queue is full")
+	case <-time.After(10 * time.Millisecond):
+	}
+
+	q.Pop()
+	if !<-pushed {
+		t.Error("push should success after pop")
+	}
+
+	q.Pop()
+	popped := make(chan *Request)
+	go func() { popped <- q.Pop() }()
+	select {
+	case <-popped:
+		t.Error("pop should block when queue is empty")
+	case <-time.After(10 * time.Millisecond):
+	}
+
+	q.Close()
+	if <-popped != nil {
+		t.Error("pop should return nil when queue is closed")
+	}
+	if q.Push(req) {
+		t.Error("push should fail when queue is closed")
+	}
+}
+
+func TestPriorityQueueHosts(t *testing.T) {
+	q := NewPriorityQueue(100).(SelectiveQueue)
+	for i, u := range []string{"http://a.com/", "http://b.com/", "http://a.com/", "http://c.com/", "http://b.com/"} {
+		req, _ := NewGetRequest(u)
+		req.Meta["i"] = i
+		q.Push(req.SetPriority(int32(i % 2)))
+	}
+
+	// only best request of each host is tried, in priority order
+	var tried []string
+	accept := func(req *Request) bool {
+		tried = append(tried, requestHost(req))
+		return requestHost(req) == "a.com"
+	}
+	if req := q.PopFunc(accept); req.Meta["i"] != 0 {
+		t.Errorf("pop func should pick first request of a.com, got %v", req.Meta["i"])
+	}
+	if len(tried) != 3 || tried[0] != "b.com" || tried[1] != "c.com" {
+		t.Errorf("hosts should be tried once in priority order, got %v", tried)
+	}
+
+	// global order is kept across hosts
+	for _, i := range []int{1, 3, 2, 4} {
+		if req := q.Pop(); req.Meta["i"] != i {
+			t.Errorf("expect request %d, got %v", i, req.Meta["i"])
+		}
+	}
+	if q.Len() != 0 {
+		t.Error("queue should be empty")
+	}
+}
+
+// plainQueue hides selective methods of underlying queue
+type plainQueue struct {
+	RequestQueue
+}
+
+func TestPrefetchQueue(t *testing.T) {
+	q := newPrefetchQueue(plainQueue{NewPriorityQueue(10)}, 2)
+	for i, u := range []string{"http://a.com/", "http://b.com/", "http://a.com/"} {
+		req, _ := NewGetRequest(u)
+		req.Meta["i"] = i
+		q.Push(req)
+	}
+
+	// request of busy host is held aside, while underlying queue is not selective
+	busy := func(req *Request) bool { return requestHost(req) != "a.com" }
+	if req := q.PopFunc(busy); req.Meta["i"] != 1 {
+		t.Errorf("pop func should skip busy host, got %v", req.Meta["i"])
+	}
+	if req := q.Pop(); req.Meta["i"] != 0 {
+		t.Errorf("held requests should pop in order, got %v", req.Meta["i"])
+	}
+	if q.Len() != 1 {
+		t.Errorf("held requests should be counted, got %d", q.Len())
+	}
+
+	popped := make(chan *Request)
+	go func() { popped <- q.PopFunc(busy) }()
+	select {
+	case <-popped:
+		t.Error("pop func should block when all held requests are rejected")
+	case <-time.After(10 * time.Millisecond):
+	}
+	if reqs := q.Drain(); len(reqs) != 1 || reqs[0].Meta["i"] != 2 {
+		t.Errorf("drain should return held requests, got %v", reqs)
+	}
+	if <-popped != nil {
+		t.Error("pop func should return nil when queue closed")
+	}
+}
@@ -0,0 +1,301 @@
+package gospider
+
+import (
+	"fmt"
+	"strconv"
+	"sync"
+	"time"
+	"github.com/go-redis/redis"
+	log "github.com/Sirupsen/logrus"
+)
+
+/**************************************************************
+* struct: redisQueue
+**************************************************************/
+
+// redisPollInterval is interval of polling redis when queue is empty or full
+var redisPollInterval = 100 * time.Millisecond
+
+// redisPopScript requeue expired leases, then pop request with highest priority
+// and lease it until deadline. KEYS: queue, lease, data, score. ARGV: now, deadline
+var redisPopScript = redis.NewScript(`
+local expired = redis.call('ZRANGEBYSCORE', KEYS[2], '-inf', ARGV[1])
+for _, id in ipairs(expired) do
+	redis.call('ZREM', KEYS[2], id)
+	local score = redis.call('HGET', KEYS[4], id)
+	if score then
+		redis.call('ZADD', KEYS[1], score, id)
+	end
+end
+local top = redis.call('ZRANGE', KEYS[1], 0, 0)
+if #top == 0 then
+	return false
+end
+local id = top[1]
+redis.call('ZREM', KEYS[1], id)
+redis.call('ZADD', KEYS[2], ARGV[2], id)
+return {id, redis.call('HGET', KEYS[3], id)}
+`)
+
+// redisQueue is a priority queue lives in redis, which is shared by engines
+// popped request is leased for a visibility timeout, if it is not acknowledged
+// in time (e.g. node crashed), it is requeued and could be popped by others
+// leases of requests held by a living node are renewed until it is drained
+type redisQueue struct {
+	client   *redis.Client
+	queue    string
+	lease    string
+	data     string
+	score    string
+	seq      string
+	capacity int
+	timeout  time.Duration
+
+	lock   sync.Mutex
+	ids    map[*Request]string
+	closed chan struct{}
+	once   sync.Once
+
+	// drained stops lease renewal
+	drained   chan struct{}
+	drainOnce sync.Once
+}
+
+// NewRedisQueue create a request queue in redis under given key prefix
+// capacity <= 0 means unbounded. timeout is visibility timeout of popped requests
+// to share a crawl between nodes, use it as EngineArgs.Queue together with
+// a redis filter (e.g. NewRedisSetFilter) as EngineArgs.Filter
+func NewRedisQueue(redisURL string, key string, capacity int, timeout time.Duration) (RequestQueue, error) {
+	client, err := newRedisClient(redisURL)
+	if err != nil {
+		return nil, err
+	}
+	self := &redisQueue{
+		client:   client,
+		queue:    key + ":queue",
+		lease:    key + ":lease",
+		data:     key + ":data",
+		score:    key + ":score",
+		seq:      key + ":seq",
+		capacity: capacity,
+		timeout:  timeout,
+		ids:      make(map[*Request]string),
+		closed:   make(chan struct{}),
+		drained:  make(chan struct{}),
+	}
+	go self.renew()
+	return self, nil
+}
+
+// redisQueue_renew extend leases of requests held by this node every third of timeout
+// so that slow requests (host delay, retry backoff, long parse) are not popped by others
+func (self *redisQueue) renew() {
+	interval := self.timeout / 3
+	if interval <= 0 {
+		return
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-self.drained:
+			return
+		case <-ticker.C:
+		}
+
+		self.lock.Lock()
+		members := make([]redis.Z, 0, len(self.ids))
+		deadline := float64(time.Now().Add(self.timeout).UnixNano() / 1e6)
+		for _, id := range self.ids {
+			members = append(members, redis.Z{Score: deadline, Member: id})
+		}
+		self.lock.Unlock()
+		if len(members) == 0 {
+			continue
+		}
+		// lease already expired and taken by others is not brought back
+		if err := self.client.ZAddXX(self.lease, members...).Err(); err != nil {
+			log.Errorf("[REDIS] renew leases failed: %s", err)
+		}
+	}
+}
+
+// redisQueue_stopRenew stops lease renewal, leases held expire after that
+func (self *redisQueue) stopRenew() {
+	self.drainOnce.Do(func() { close(self.drained) })
+}
+
+// redisQueue_Shared marks queue as shared by engines
+func (self *redisQueue) Shared() {}
+
+// redisQueue_wait sleep a poll interval. return false if queue is closed
+func (self *redisQueue) wait() bool {
+	select {
+	case <-self.closed:
+		return false
+	case <-time.After(redisPollInterval):
+		return true
+	}
+}
+
+// redisQueue_Push will block when queue is full
+// higher priority has lower score, FIFO among equal priorities via padded id
+func (self *redisQueue) Push(req *Request) bool {
+	for self.capacity > 0 {
+		n, err := self.client.ZCard(self.queue).Result()
+		if err == nil && n < int64(self.capacity) {
+			break
+		}
+		if err != nil {
+			log.Errorf("[REDIS] queue length failed: %s", err)
+		}
+		if !self.wait() {
+			return false
+		}
+	}
+	select {
+	case <-self.closed:
+		return false
+	default:
+	}
+
+	data, err := req.Marshal()
+	if err != nil {
+		log.Errorf("[REDIS] marshal %s failed: %s", req.Repr(), err)
+		return false
+	}
+	seq, err := self.client.Incr(self.seq).Result()
+	if err != nil {
+		log.Errorf("[REDIS] push %s failed: %s", req.Repr(), err)
+		return false
+	}
+
+	id := fmt.Sprintf("%020d", seq)
+	score := float64(-req.Priority)
+	pipe := self.client.TxPipeline()
+	pipe.HSet(self.data, id, data)
+	pipe.HSet(self.score, id, score)
+	pipe.ZAdd(self.queue, redis.Z{Score: score, Member: id})
+	if _, err = pipe.Exec(); err != nil {
+		log.Errorf("[REDIS] push %s failed: %s", req.Repr(), err)
+		return false
+	}
+	return true
+}
+
+// redisQueue_Pop will poll redis until there is a request or queue is closed
+func (self *redisQueue) Pop() *Request {
+	for {
+		now := time.Now()
+		deadline := now.Add(self.timeout)
+		result, err := redisPopScript.Run(self.client,
+			[]string{self.queue, self.lease, self.data, self.score},
+			now.UnixNano()/1e6, deadline.UnixNano()/1e6,
+		).Result()
+
+		if err != nil && err != redis.Nil {
+			log.Errorf("[REDIS] pop failed: %s", err)
+		} else if pair, ok := result.([]interface{}); ok && len(pair) == 2 {
+			id, _ := pair[0].(string)
+			data, _ := pair[1].(string)
+			req, err := UnmarshalRequest([]byte(data))
+			if err == nil {
+				self.lock.Lock()
+				self.ids[req] = id
+				self.lock.Unlock()
+				return req
+			}
+			log.Errorf("[REDIS] drop broken request %s: %s", id, err)
+			self.remove(id)
+			continue
+		}
+
+		if !self.wait() {
+			return nil
+		}
+	}
+}
+
+// redisQueue_Ack will remove request from redis
+func (self *redisQueue) Ack(req *Request) {
+	self.lock.Lock()
+	id, ok := self.ids[req]
+	delete(self.ids, req)
+	self.lock.Unlock()
+	if ok {
+		self.remove(id)
+	}
+}
+
+// redisQueue_remove delete request by id
+func (self *redisQueue) remove(id string) {
+	pipe := self.client.TxPipeline()
+	pipe.ZRem(self.lease, id)
+	pipe.HDel(self.data, id)
+	pipe.HDel(self.score, id)
+	if _, err := pipe.Exec(); err != nil {
+		log.Errorf("[REDIS] ack %s failed: %s", id, err)
+	}
+}
+
+// redisQueue_Len returns number of requests waiting in redis
+func (self *redisQueue) Len() int {
+	n, err := self.client.ZCard(self.queue).Result()
+	if err != nil {
+		log.Errorf("[REDIS] queue length failed: %s", err)
+	}
+	return int(n)
+}
+
+// redisQueue_Close will wake up polling Push & Pop
+func (self *redisQueue) Close() {
+	self.once.Do(func() { close(self.closed) })
+}
+
+// redisQueue_leased tells whether req is popped by this node and not acknowledged
+func (self *redisQueue) leased(req *Request) bool {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	_, ok := self.ids[req]
+	return ok
+}
+
+// redisQueue_Drain returns nothing since requests stay in redis for other engines
+// requests leased by this node but not acknowledged are released immediately,
+// engine leaves them out of its pending data so they are crawled only once
+func (self *redisQueue) Drain() []*Request {
+	self.stopRenew()
+	self.lock.Lock()
+	ids := self.ids
+	self.ids = make(map[*Request]string)
+	self.lock.Unlock()
+
+	for _, id := range ids {
+		score, err := self.client.HGet(self.score, id).Result()
+		if err != nil {
+			continue
+		}
+		s, _ := strconv.ParseFloat(score, 64)
+		pipe := self.client.TxPipeline()
+		pipe.ZRem(self.lease, id)
+		pipe.ZAdd(self.queue, redis.Z{Score: s, Member: id})
+		if _, err := pipe.Exec(); err != nil {
+			log.Errorf("[REDIS] release %s failed: %s", id, err)
+		}
+	}
+	return nil
+}
+
+// newRedisClient create redis client from url and check connection
+func newRedisClient(redisURL string) (*redis.Client, error) {
+	ops, err := redis.ParseURL(redisURL)
+	if err != nil {
+		return nil, err
+	}
+	client := redis.NewClient(ops)
+
+	if _, err = client.Ping().Result(); err != nil {
+		return nil, err
+	}
+	return client, nil
+}
@@ -0,0 +1,137 @@
+package gospider
+
+import (
+	"testing"
+	"time"
+	"github.com/alicebob/miniredis/v2"
+)
+
+func TestRedisQueue(t *testing.T) {
+	server, err := miniredis.Run()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+	redisURL := "redis://" + server.Addr()
+
+	// two nodes share one queue
+	nodeA, err := NewRedisQueue(redisURL, "test", 0, 50*time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+	nodeB, _ := NewRedisQueue(redisURL, "test", 0, 50*time.Millisecond)
+
+	for i, prior := range []int32{0, 5, 0} {
+		req, _ := NewGetRequest("http://a.com/")
+		req.Meta["i"] = i
+		nodeA.Push(req.SetPriority(prior))
+	}
+
+	first := nodeB.Pop()
+	if i, _ := first.Meta.GetInt("i"); i != 1 {
+		t.Errorf("highest priority should pop first, got %d", i)
+	}
+	second := nodeA.Pop()
+	if i, _ := second.Meta.GetInt("i"); i != 0 {
+		t.Errorf("FIFO among equal priority, got %d", i)
+	}
+	nodeB.(AckQueue).Ack(first)
+
+	// node A holds request longer than timeout, its lease is renewed
+	time.Sleep(150 * time.Millisecond)
+	third := nodeB.Pop()
+	if i, _ := third.Meta.GetInt("i"); i != 2 {
+		t.Errorf("request held by living node should not be requeued, got %d", i)
+	}
+	nodeB.(AckQueue).Ack(third)
+
+	// node A crashes without ack, its lease expires and request is requeued
+	nodeA.(*redisQueue).stopRenew()
+	time.Sleep(100 * time.Millisecond)
+	fourth := nodeB.Pop()
+	if i, _ := fourth.Meta.GetInt("i"); i != 0 {
+		t.Errorf("expired lease should be requeued, got %d", i)
+	}
+	nodeB.(AckQueue).Ack(fourth)
+
+	popped := make(chan *Request)
+	go func() { popped <- nodeB.Pop() }()
+	nodeB.Close()
+	select {
+	case req := <-popped:
+		if req != nil {
+			t.Error("pop should return nil when closed")
+		}
+	case <-time.After(time.Second):
+		t.Error("close should wake up blocking pop")
+	}
+}
+
+func TestRedisEngine(t *testing.T) {
+	server, err := miniredis.Run()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+	redisURL := "redis://" + server.Addr()
+
+	queue, err := NewRedisQueue(redisURL, "test", 0, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	filter, _ := NewRedisSetFilter(redisURL, "test:seen")
+	args := NewEngineArgs()
+	args.Queue = queue
+	args.Filter = filter
+	engine := NewEngine(args)
+
+	req, _ := NewGetRequest("http://a.com/")
+	if !engine.PutRequest(req) {
+		t.Error("request should be scheduled")
+	}
+	dupe, _ := NewGetRequest("http://a.com/")
+	if engine.PutRequest(dupe) {
+		t.Error("duplicate request should be filtered by redis")
+	}
+	if got := engine.GetRequest(); got == nil || got.URL.String() != "http://a.com/" {
+		t.Error("request should be fetched from redis")
+	}
+}
+
+func TestRedisEngineStop(t *testing.T) {
+	server, err := miniredis.Run()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+	redisURL := "redis://" + server.Addr()
+
+	queue, _ := NewRedisQueue(redisURL, "test", 0, time.Minute)
+	args := NewEngineArgs()
+	args.Queue = queue
+	engine := NewEngine(args).(*myEngine)
+	for _, u := range []string{"http://a.com/", "http://b.com/", "http://c.com/"} {
+		req, _ := NewGetRequest(u)
+		queue.Push(req)
+	}
+
+	// engine stops with a request aborted and a response not parsed yet
+	aborted := engine.GetRequest()
+	engine.stash(aborted)
+	res := FakeResponse("http://b.com/", "")
+	res.ack = engine.GetRequest()
+	engine.stash(res)
+	engine.shutdown()
+
+	// requests released to redis are not handed back as pending too
+	for _, datum := range engine.drain() {
+		t.Errorf("released request should not be pending: %s", datum.Repr())
+	}
+	other, _ := NewRedisQueue(redisURL, "test", 0, time.Minute)
+	defer other.Close()
+	for i := 0; i < 3; i++ {
+		if other.Pop() == nil {
+			t.Error("released request should be popped by other node")
+		}
+	}
+}
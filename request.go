@@ -3,7 +3,11 @@ package gospider
 import (
 	"net/http"
 	"io"
+	"io/ioutil"
+	"bytes"
 	"fmt"
+	"encoding/json"
+	"time"
 )
 
 /**************************************************************
@@ -12,6 +16,35 @@ import (
 // MetaMap holds meta info that attach to request & response
 type MetaMap map[string]interface{}
 
+// MetaMap_GetInt will access meta and assume an integer value
+// numbers restored from json (float64 or json.Number) are accepted too
+func (meta MetaMap) GetInt(key string) (int, bool) {
+	switch v := meta[key].(type) {
+	case int:
+		return v, true
+	case int32:
+		return int(v), true
+	case int64:
+		return int(v), true
+	case float64:
+		return int(v), true
+	case json.Number:
+		i, err := v.Int64()
+		return int(i), err == nil
+	}
+	return 0, false
+}
+
+// MetaMap_GetDuration will access meta and assume a duration value
+// integers are taken as nanoseconds, which is how json encodes time.Duration
+func (meta MetaMap) GetDuration(key string) (time.Duration, bool) {
+	if v, ok := meta[key].(time.Duration); ok {
+		return v, true
+	}
+	n, ok := meta.GetInt(key)
+	return time.Duration(n), ok
+}
+
 /**************************************************************
 * struct: Request
 **************************************************************/
@@ -70,9 +103,9 @@ func (req *Request) SetCallback(parserName string) *Request {
 	return req
 }
 
-// Request_SetErrback will set callback name to Meta
+// Request_SetErrback will set errback name which handles download failure
 func (req *Request) SetErrback(errbackName string) *Request {
-	req.Callback = errbackName
+	req.Errback = errbackName
 	return req
 }
 
@@ -82,7 +115,127 @@ func (req *Request) SetPriority(prior int32) *Request {
 	return req
 }
 
+// Request_RetryTimes returns how many times request has been retried
+func (req *Request) RetryTimes() int {
+	n, _ := req.Meta.GetInt(KeyRetryTimes)
+	return n
+}
+
+// Request_SetTTL will override how long request stays seen in TTL filters
+// ttl <= 0 makes request always pass, while its fetch time is still recorded
+func (req *Request) SetTTL(ttl time.Duration) *Request {
+	if req.Meta == nil {
+		req.Meta = make(MetaMap, 1)
+	}
+	req.Meta[KeyTTL] = ttl
+	return req
+}
+
 func (req *Request) DisableFilter() *Request {
 	req.IgnoreDupe = true
 	return req
 }
+
+/**************************************************************
+* serialization: Request
+**************************************************************/
+
+// requestJSON is serializable form of Request
+type requestJSON struct {
+	Method     string      `json:"method"`
+	URL        string      `json:"url"`
+	Header     http.Header `json:"header,omitempty"`
+	Body       []byte      `json:"body,omitempty"`
+	Meta       MetaMap     `json:"meta,omitempty"`
+	Callback   string      `json:"callback,omitempty"`
+	Errback    string      `json:"errback,omitempty"`
+	IgnoreDupe bool        `json:"ignore_dupe,omitempty"`
+	Priority   int32       `json:"priority,omitempty"`
+}
+
+// Request_BodyBytes returns body of request without consuming it
+// body without GetBody is read and replaced by a re-readable one
+// if reading fails, bytes read so far are put back before the rest of body
+func (req *Request) BodyBytes() ([]byte, error) {
+	if req.GetBody != nil {
+		rc, err := req.GetBody()
+		if err != nil {
+			return nil, err
+		}
+		defer rc.Close()
+		return ioutil.ReadAll(rc)
+	}
+	if req.Body == nil || req.Body == http.NoBody {
+		return nil, nil
+	}
+
+	body, err := ioutil.ReadAll(req.Body)
+	if err != nil {
+		req.Body = struct {
+			io.Reader
+			io.Closer
+		}{io.MultiReader(bytes.NewReader(body), req.Body), req.Body}
+		return nil, err
+	}
+	req.Body.Close()
+	req.Body = ioutil.NopCloser(bytes.NewReader(body))
+	req.GetBody = func() (io.ReadCloser, error) {
+		return ioutil.NopCloser(bytes.NewReader(body)), nil
+	}
+	return body, nil
+}
+
+// Request_Marshal using json to serialize request
+// body is read through GetBody, so request is still sendable after that
+// do not fill value that is not JSON serializable in meta
+func (req *Request) Marshal() ([]byte, error) {
+	body, err := req.BodyBytes()
+	if err != nil {
+		return nil, err
+	}
+
+	return json.Marshal(requestJSON{
+		Method:     req.Method,
+		URL:        req.URL.String(),
+		Header:     req.Header,
+		Body:       body,
+		Meta:       req.Meta,
+		Callback:   req.Callback,
+		Errback:    req.Errback,
+		IgnoreDupe: req.IgnoreDupe,
+		Priority:   req.Priority,
+	})
+}
+
+// UnmarshalRequest will deserialize request from []byte
+// numbers in meta are restored as float64, use MetaMap.GetInt to access them
+func UnmarshalRequest(data []byte) (*Request, error) {
+	var v requestJSON
+	if err := json.Unmarshal(data, &v); err != nil {
+		return nil, err
+	}
+
+	var body io.Reader
+	if len(v.Body) > 0 {
+		body = bytes.NewReader(v.Body)
+	}
+	httpReq, err := http.NewRequest(v.Method, v.URL, body)
+	if err != nil {
+		return nil, err
+	}
+	if v.Header != nil {
+		httpReq.Header = v.Header
+	}
+	if v.Meta == nil {
+		v.Meta = make(MetaMap, 2)
+	}
+
+	return &Request{
+		Request:    httpReq,
+		Meta:       v.Meta,
+		Callback:   v.Callback,
+		Errback:    v.Errback,
+		IgnoreDupe: v.IgnoreDupe,
+		Priority:   v.Priority,
+	}, nil
+}
@@ -1,7 +1,11 @@
 package gospider
 
 import (
+	"bytes"
+	"context"
 	"fmt"
+	"io"
+	"io/ioutil"
 	"strings"
 	"net/http"
 )
@@ -11,9 +15,26 @@ import (
 **************************************************************/
 
 // Response hold http.Response and corresponding Request
+// body is buffered on first call of Body or Text, after that each call of
+// Body and each parser gets a fresh Response.Body reading from the beginning
 type Response struct {
 	*http.Response
 	Request *Request
+
+	// Truncated is set when body exceeds max size and the rest is discarded
+	Truncated bool
+
+	// BodyFile is temp file holding body in streaming mode, removed when body is closed
+	BodyFile string
+
+	body     []byte
+	bodyErr  error
+	buffered bool
+
+	// ack is request acknowledged by engine once response is analyzed
+	ack *Request
+
+	ctx context.Context
 }
 
 // NewResponse create a new response and attach origin request to it
@@ -21,11 +42,109 @@ func NewResponse(res *http.Response, req *Request) *Response {
 	return &Response{Response: res, Request: req}
 }
 
+// Response_Context returns context attached to response
+// parser could use it to abort early. never returns nil
+func (res *Response) Context() context.Context {
+	if res.ctx != nil {
+		return res.ctx
+	}
+	return context.Background()
+}
+
+// Response_WithContext returns a shallow copy of res with ctx attached
+func (res *Response) WithContext(ctx context.Context) *Response {
+	r := *res
+	r.ctx = ctx
+	return &r
+}
+
+// Response_Body returns whole body, which is read and buffered on first call
+// content encoding is already decoded by downloader. streamed body is loaded
+// into memory and its temp file removed, read Response.Body to avoid that
+// Response.Body is rewound by every call, call Body before reading it
+func (res *Response) Body() ([]byte, error) {
+	if res.Response == nil || res.Response.Body == nil {
+		return res.body, res.bodyErr
+	}
+	if !res.buffered {
+		raw := res.Response.Body
+		res.body, res.bodyErr = ioutil.ReadAll(raw)
+		raw.Close()
+		res.buffered, res.BodyFile = true, ""
+	}
+	res.rewind()
+	return res.body, res.bodyErr
+}
+
+// Response_rewind replace buffered Response.Body with a fresh reader
+// so readers handed out before, even unfinished, never affect the next one
+func (res *Response) rewind() {
+	if res.buffered && res.Response != nil {
+		res.Response.Body = &replayBody{reader: bytes.NewReader(res.body), data: res.body}
+	}
+}
+
+// Response_Text returns body decoded into UTF-8 text, see Charset
+func (res *Response) Text() (string, error) {
+	body, err := res.Body()
+	if err != nil {
+		return "", err
+	}
+	return decodeText(body, res.contentType())
+}
+
+// Response_Charset returns charset name of body, detected from Content-Type header,
+// <meta> tag in html and sniffing bytes in turn. GBK & GB2312 are read as GB18030
+func (res *Response) Charset() string {
+	body, _ := res.Body()
+	_, name := detectCharset(body, res.contentType())
+	return name
+}
+
+// Response_contentType returns Content-Type header, empty if there is no header
+func (res *Response) contentType() string {
+	if res.Response == nil {
+		return ""
+	}
+	return res.Header.Get("Content-Type")
+}
+
+// closeResponse close body of res if there is one
+func closeResponse(res *Response) {
+	if res != nil && res.Response != nil && res.Response.Body != nil {
+		res.Response.Body.Close()
+	}
+}
+
 // Response_Repr implement Data interface
 func (res *Response) Repr() string {
 	return fmt.Sprintf("%+v", res)
 }
 
+/**************************************************************
+* type: replayBody
+**************************************************************/
+
+// replayBody is buffered body, which rewinds to beginning when EOF is reached
+// or closed. Response.rewind hands out a new one for reader stopping early
+type replayBody struct {
+	reader *bytes.Reader
+	data   []byte
+}
+
+func (self *replayBody) Read(b []byte) (n int, err error) {
+	if n, err = self.reader.Read(b); err == io.EOF {
+		self.reader.Reset(self.data)
+	}
+	return
+}
+
+// replayBody_Close rewinds body, buffered data is kept
+func (self *replayBody) Close() error {
+	self.reader.Reset(self.data)
+	return nil
+}
+
 /**************************************************************
 * type: fakeBody(string)
 **************************************************************/
@@ -0,0 +1,115 @@
+package gospider
+
+import (
+	"context"
+	"errors"
+	"io"
+	"math/rand"
+	"net"
+	"net/http"
+	"syscall"
+	"time"
+)
+
+/**************************************************************
+* struct: RetryPolicy
+**************************************************************/
+
+// RetryPolicy decides whether and when a failed download is retried
+// retried request bypass dupe filter, retry times is kept in Meta[KeyRetryTimes]
+type RetryPolicy struct {
+	// MaxRetries is max retry times of each request
+	MaxRetries int
+
+	// StatusCodes are response status that should be retried
+	StatusCodes []int
+
+	// BaseDelay is backoff of first retry, doubled each time until MaxDelay
+	BaseDelay time.Duration
+	MaxDelay  time.Duration
+
+	// Jitter in [0,1] randomly shortens backoff by at most such fraction
+	Jitter float64
+
+	// Budget limits retries to a fraction of all downloads (e.g. 0.1)
+	// MaxRetries retries are always allowed. zero means no budget
+	Budget float64
+}
+
+// NewRetryPolicy returns default presets
+func NewRetryPolicy() *RetryPolicy {
+	return &RetryPolicy{
+		MaxRetries: 3,
+		StatusCodes: []int{
+			http.StatusInternalServerError,
+			http.StatusBadGateway,
+			http.StatusServiceUnavailable,
+			http.StatusGatewayTimeout,
+			http.StatusRequestTimeout,
+			http.StatusTooManyRequests,
+		},
+		BaseDelay: time.Second,
+		MaxDelay:  time.Minute,
+		Jitter:    0.5,
+	}
+}
+
+// RetryPolicy_ShouldRetry tells whether download result should be retried
+// only transient network errors and listed status codes are retried
+// it does not take retry times into account
+func (self *RetryPolicy) ShouldRetry(res *Response, err error) bool {
+	if err != nil {
+		return Transient(err)
+	}
+	if res == nil || res.Response == nil {
+		return false
+	}
+	for _, code := range self.StatusCodes {
+		if res.StatusCode == code {
+			return true
+		}
+	}
+	return false
+}
+
+// Transient tells whether download error is likely to go away on retry:
+// timeouts, connection reset or refused, and connections closed halfway
+// cancellation, dropped request, bad url or dns miss are permanent
+func Transient(err error) bool {
+	if err == nil || errors.Is(err, ErrDropRequest) ||
+		errors.Is(err, context.Canceled) {
+		return false
+	}
+	if errors.Is(err, context.DeadlineExceeded) ||
+		errors.Is(err, io.ErrUnexpectedEOF) || errors.Is(err, io.EOF) ||
+		errors.Is(err, syscall.ECONNRESET) || errors.Is(err, syscall.ECONNREFUSED) ||
+		errors.Is(err, syscall.ECONNABORTED) || errors.Is(err, syscall.EPIPE) {
+		return true
+	}
+	var dnsErr *net.DNSError
+	if errors.As(err, &dnsErr) {
+		return dnsErr.IsTimeout || dnsErr.IsTemporary
+	}
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return true
+	}
+	var opErr *net.OpError
+	return errors.As(err, &opErr)
+}
+
+// RetryPolicy_Backoff returns delay before n-th retry (start from 1)
+// Retry-After of response is honored if it is longer
+func (self *RetryPolicy) Backoff(n int, res *Response) time.Duration {
+	delay := self.BaseDelay
+	for i := 1; i < n && (self.MaxDelay <= 0 || delay < self.MaxDelay); i++ {
+		delay *= 2
+	}
+	if self.MaxDelay > 0 && delay > self.MaxDelay {
+		delay = self.MaxDelay
+	}
+	if self.Jitter > 0 && delay > 0 {
+		delay -= time.Duration(rand.Float64() * self.Jitter * float64(delay))
+	}
+	return maxDuration(delay, RetryAfter(res, time.Now()))
+}
@@ -0,0 +1,48 @@
+package gospider
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"syscall"
+	"testing"
+)
+
+func TestRetryPolicyShouldRetry(t *testing.T) {
+	policy := NewRetryPolicy()
+	wrap := func(err error) error {
+		return &url.Error{Op: "Get", URL: "http://a.com/", Err: err}
+	}
+	refused := &net.OpError{Op: "dial", Net: "tcp", Err: syscall.ECONNREFUSED}
+	timeout := &net.DNSError{Err: "i/o timeout", Name: "a.com", IsTimeout: true}
+	missing := &net.DNSError{Err: "no such host", Name: "a.com", IsNotFound: true}
+
+	for _, c := range []struct {
+		err   error
+		retry bool
+	}{
+		{wrap(refused), true},
+		{wrap(io.ErrUnexpectedEOF), true},
+		{wrap(io.EOF), true},
+		{wrap(context.DeadlineExceeded), true},
+		{wrap(&net.OpError{Op: "dial", Net: "tcp", Err: timeout}), true},
+		{wrap(&net.OpError{Op: "dial", Net: "tcp", Err: missing}), false},
+		{wrap(context.Canceled), false},
+		{wrap(errors.New("unsupported protocol scheme")), false},
+		{fmt.Errorf("middleware: %w", ErrDropRequest), false},
+		{ErrBodyTooLarge, false},
+	} {
+		if policy.ShouldRetry(nil, c.err) != c.retry {
+			t.Errorf("retry %v should be %v", c.err, c.retry)
+		}
+	}
+
+	res := FakeResponse("http://a.com/", "")
+	res.StatusCode = 503
+	if !policy.ShouldRetry(res, nil) {
+		t.Error("listed status code should be retried")
+	}
+}
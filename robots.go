@@ -0,0 +1,310 @@
+package gospider
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	log "github.com/Sirupsen/logrus"
+)
+
+// Default settings of robots middleware
+var (
+	DefaultRobotsTTL     = 24 * time.Hour
+	DefaultRobotsMaxSize = int64(500 * 1024)
+)
+
+/**************************************************************
+* struct: robotsRules
+**************************************************************/
+
+// robotsRule is an allow or disallow rule of path pattern
+type robotsRule struct {
+	pattern string
+	allow   bool
+}
+
+// robotsRules is the group of rules that applies to our user agent
+type robotsRules struct {
+	rules      []robotsRule
+	crawlDelay time.Duration
+}
+
+// robotsGroup is a group of rules in robots.txt
+type robotsGroup struct {
+	agents []string
+	robotsRules
+}
+
+// parseRobots parse robots.txt and pick group for userAgent
+// group with longest agent token contained in userAgent wins, then `*`
+func parseRobots(r io.Reader, userAgent string) *robotsRules {
+	var groups []*robotsGroup
+	var cur *robotsGroup
+	inAgents := false
+
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if i := strings.IndexByte(line, '#'); i >= 0 {
+			line = line[:i]
+		}
+		i := strings.IndexByte(line, ':')
+		if i < 0 {
+			continue
+		}
+		key := strings.ToLower(strings.TrimSpace(line[:i]))
+		value := strings.TrimSpace(line[i+1:])
+
+		switch key {
+		case "user-agent":
+			// consecutive user-agent lines share one group
+			if !inAgents {
+				cur = &robotsGroup{}
+				groups = append(groups, cur)
+				inAgents = true
+			}
+			cur.agents = append(cur.agents, strings.ToLower(value))
+		case "allow", "disallow":
+			inAgents = false
+			if cur == nil {
+				continue
+			}
+			// empty disallow means allow all, which is the default
+			if value != "" {
+				cur.rules = append(cur.rules, robotsRule{pattern: value, allow: key == "allow"})
+			}
+		case "crawl-delay":
+			inAgents = false
+			if cur == nil {
+				continue
+			}
+			if secs, err := strconv.ParseFloat(value, 64); err == nil && secs > 0 {
+				cur.crawlDelay = time.Duration(secs * float64(time.Second))
+			}
+		}
+	}
+
+	userAgent = strings.ToLower(userAgent)
+	var best *robotsGroup
+	bestLen := -1
+	for _, g := range groups {
+		for _, agent := range g.agents {
+			l := -1
+			if agent == "*" {
+				l = 0
+			} else if agent != "" && strings.Contains(userAgent, agent) {
+				l = len(agent)
+			}
+			if l > bestLen {
+				best, bestLen = g, l
+			}
+		}
+	}
+	if best == nil {
+		return &robotsRules{}
+	}
+	return &best.robotsRules
+}
+
+// robotsRules_allowed test path (with query) against rules
+// longest matching pattern wins, allow wins on tie
+func (self *robotsRules) allowed(path string) bool {
+	if path == "/robots.txt" {
+		return true
+	}
+	allow, matched := true, -1
+	for _, rule := range self.rules {
+		if !robotsMatch(rule.pattern, path) {
+			continue
+		}
+		if l := len(rule.pattern); l > matched || (l == matched && rule.allow) {
+			allow, matched = rule.allow, l
+		}
+	}
+	return allow
+}
+
+// robotsMatch match path against pattern with `*` wildcard and `$` end anchor
+func robotsMatch(pattern, path string) bool {
+	anchored := strings.HasSuffix(pattern, "$")
+	if anchored {
+		pattern = pattern[:len(pattern)-1]
+	}
+	parts := strings.Split(pattern, "*")
+	if !strings.HasPrefix(path, parts[0]) {
+		return false
+	}
+	pos := len(parts[0])
+	for i := 1; i < len(parts); i++ {
+		if anchored && i == len(parts)-1 {
+			return len(path)-pos >= len(parts[i]) && strings.HasSuffix(path, parts[i])
+		}
+		idx := strings.Index(path[pos:], parts[i])
+		if idx < 0 {
+			return false
+		}
+		pos += idx + len(parts[i])
+	}
+	return !anchored || pos == len(path)
+}
+
+/**************************************************************
+* struct: RobotsMiddleware
+**************************************************************/
+
+// robotsEntry is cached robots.txt of a site. ready is closed when fetched
+type robotsEntry struct {
+	ready  chan struct{}
+	rules  *robotsRules
+	expire time.Time
+}
+
+// RobotsMiddleware drops requests disallowed by robots.txt with ErrRobotsDisallowed
+// robots.txt is fetched with Downloader once per site and cached for TTL.
+// Crawl-delay of a host is used as minimum host delay by engine.
+type RobotsMiddleware struct {
+	NopDownloaderMiddleware
+
+	// Downloader fetches robots.txt. use the wrapped one rather than the chain
+	Downloader Downloader
+
+	// UserAgent picks rule group and is sent when fetching robots.txt
+	UserAgent string
+
+	// TTL is how long robots.txt is cached
+	TTL time.Duration
+
+	// MaxSize is max bytes of robots.txt read, the rest is ignored
+	MaxSize int64
+
+	lock   sync.Mutex
+	sites  map[string]*robotsEntry
+	delays map[string]time.Duration
+}
+
+// NewRobotsMiddleware create robots middleware fetching with downloader as userAgent
+func NewRobotsMiddleware(downloader Downloader, userAgent string) *RobotsMiddleware {
+	return &RobotsMiddleware{
+		Downloader: downloader,
+		UserAgent:  userAgent,
+		TTL:        DefaultRobotsTTL,
+		MaxSize:    DefaultRobotsMaxSize,
+		sites:      make(map[string]*robotsEntry),
+		delays:     make(map[string]time.Duration),
+	}
+}
+
+// RobotsMiddleware_ProcessRequest drops disallowed request
+func (self *RobotsMiddleware) ProcessRequest(req *Request) (Data, error) {
+	return self.ProcessRequestContext(context.Background(), req)
+}
+
+// RobotsMiddleware_ProcessRequestContext drops disallowed request
+// fetching robots.txt is aborted with ctx.Err() when ctx is done
+// implements ContextDownloaderMiddleware
+func (self *RobotsMiddleware) ProcessRequestContext(ctx context.Context, req *Request) (Data, error) {
+	if req.URL == nil {
+		return nil, nil
+	}
+	rules, err := self.rules(ctx, req)
+	if err != nil {
+		return nil, err
+	}
+	if !rules.allowed(req.URL.RequestURI()) {
+		log.Debugf("[DOWN] %s disallowed by robots.txt", req.URL)
+		return nil, ErrRobotsDisallowed
+	}
+	return nil, nil
+}
+
+// RobotsMiddleware_HostDelay returns Crawl-delay of host, zero if unknown
+// implements HostDelayer
+func (self *RobotsMiddleware) HostDelay(host string) time.Duration {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	return self.delays[strings.ToLower(host)]
+}
+
+// RobotsMiddleware_rules returns rules for site of req, fetch if needed
+// concurrent requests to same site wait for one fetch. fetch aborted by
+// ctx is not cached, then waiting requests fetch again with their own ctx
+func (self *RobotsMiddleware) rules(ctx context.Context, req *Request) (*robotsRules, error) {
+	site := strings.ToLower(req.URL.Scheme + "://" + req.URL.Host)
+	for {
+		self.lock.Lock()
+		entry, ok := self.sites[site]
+		if ok {
+			select {
+			case <-entry.ready:
+				if entry.rules == nil || time.Now().After(entry.expire) {
+					ok = false
+				}
+			default:
+			}
+		}
+		if !ok {
+			entry = &robotsEntry{ready: make(chan struct{})}
+			self.sites[site] = entry
+			self.lock.Unlock()
+
+			rules := self.fetch(ctx, site)
+			if err := ctx.Err(); err != nil {
+				close(entry.ready)
+				return nil, err
+			}
+			entry.rules = rules
+			entry.expire = time.Now().Add(self.TTL)
+			self.lock.Lock()
+			self.delays[strings.ToLower(req.URL.Host)] = rules.crawlDelay
+			self.lock.Unlock()
+			close(entry.ready)
+			return rules, nil
+		}
+		self.lock.Unlock()
+
+		select {
+		case <-entry.ready:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+		if entry.rules != nil {
+			return entry.rules, nil
+		}
+	}
+}
+
+// RobotsMiddleware_fetch download & parse robots.txt of site
+// 4xx means no restriction. failure is logged and treated as no restriction either
+func (self *RobotsMiddleware) fetch(ctx context.Context, site string) *robotsRules {
+	req, err := NewGetRequest(site + "/robots.txt")
+	if err != nil {
+		return &robotsRules{}
+	}
+	if self.UserAgent != "" {
+		req.Header.Set("User-Agent", self.UserAgent)
+	}
+
+	res, err := DownloadContext(ctx, self.Downloader, req)
+	if err != nil {
+		closeResponse(res)
+	}
+	if err != nil && ctx.Err() != nil {
+		return &robotsRules{}
+	}
+	if err != nil || res == nil || res.Response == nil {
+		log.Warnf("[DOWN] fetch %s/robots.txt failed: %v", site, err)
+		return &robotsRules{}
+	}
+	defer res.Response.Body.Close()
+	if res.StatusCode < 200 || res.StatusCode >= 300 {
+		if res.StatusCode >= 500 {
+			log.Warnf("[DOWN] fetch %s/robots.txt failed with status %d", site, res.StatusCode)
+		}
+		return &robotsRules{}
+	}
+	return parseRobots(io.LimitReader(res.Response.Body, self.MaxSize), self.UserAgent)
+}
@@ -0,0 +1,154 @@
+package gospider
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+const testRobots = `
+# comment
+User-agent: otherbot
+Disallow: /
+
+User-agent: *
+User-agent: gospider
+Disallow: /private
+Allow: /private/public
+Disallow: /*.pdf$
+Crawl-delay: 0.05
+`
+
+func TestParseRobots(t *testing.T) {
+	rules := parseRobots(strings.NewReader(testRobots), "Mozilla/5.0 (compatible; gospider/1.0)")
+	cases := map[string]bool{
+		"/":                   true,
+		"/private":            false,
+		"/private/x?a=1":      false,
+		"/private/public/x":   true,
+		"/doc.pdf":            false,
+		"/doc.pdf?download=1": true,
+		"/robots.txt":         true,
+	}
+	for path, allowed := range cases {
+		if rules.allowed(path) != allowed {
+			t.Errorf("%s should be allowed=%v", path, allowed)
+		}
+	}
+	if rules.crawlDelay != 50*time.Millisecond {
+		t.Errorf("wrong crawl delay %s", rules.crawlDelay)
+	}
+
+	if parseRobots(strings.NewReader(testRobots), "OtherBot/2.0").allowed("/") {
+		t.Error("specific group should take precedence over *")
+	}
+}
+
+func TestRobotsMiddleware(t *testing.T) {
+	fetched := NewCounter()
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/robots.txt" {
+			fetched.Inc()
+			if r.UserAgent() != "gospider" {
+				t.Errorf("robots.txt should be fetched as gospider, got %s", r.UserAgent())
+			}
+			fmt.Fprint(w, testRobots)
+			return
+		}
+		fmt.Fprint(w, r.URL.Path)
+	}))
+	defer server.Close()
+
+	base, _ := NewDownloader(nil)
+	robots := NewRobotsMiddleware(base, "gospider")
+	downloader := NewDownloaderChain(base, robots)
+
+	for i := 0; i < 3; i++ {
+		req, _ := NewGetRequest(server.URL + "/public")
+		if _, err := downloader.Download(req); err != nil {
+			t.Errorf("allowed request failed: %s", err)
+		}
+	}
+	req, _ := NewGetRequest(server.URL + "/private/x")
+	_, err := downloader.Download(req)
+	if err != ErrRobotsDisallowed || !errors.Is(err, ErrDropRequest) {
+		t.Errorf("disallowed request should be dropped, got %v", err)
+	}
+	if fetched.Get() != 1 {
+		t.Errorf("robots.txt should be fetched once, got %d", fetched.Get())
+	}
+
+	// crawl delay feeds host limiter
+	delayers := hostDelayers(downloader)
+	if len(delayers) != 1 || delayers[0].HostDelay(req.URL.Host) != 50*time.Millisecond {
+		t.Fatal("robots middleware should provide crawl delay")
+	}
+	limiter := newHostLimiter(HostPolicy{}, nil, nil, delayers, nil)
+	if !limiter.TryAcquire(req) {
+		t.Error("free host should be acquired")
+	}
+	limiter.Release(req, 0, nil)
+	if limiter.TryAcquire(req) {
+		t.Error("host should be delayed by crawl delay")
+	}
+}
+
+func TestRobotsMiddlewareContext(t *testing.T) {
+	fetched := NewCounter()
+	unblock := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/robots.txt" {
+			fetched.Inc()
+			select {
+			case <-unblock:
+			case <-r.Context().Done():
+				return
+			}
+			fmt.Fprint(w, testRobots)
+			return
+		}
+		fmt.Fprint(w, r.URL.Path)
+	}))
+	defer server.Close()
+
+	base, _ := NewDownloader(nil)
+	downloader := NewDownloaderChain(base, NewRobotsMiddleware(base, "gospider")).(ContextDownloader)
+
+	// slow robots.txt fetch is aborted with request context
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	req, _ := NewGetRequest(server.URL + "/private/x")
+	start := time.Now()
+	if _, err := downloader.DownloadContext(ctx, req); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("robots fetch should be aborted by context, got %v", err)
+	}
+	if time.Since(start) > time.Second {
+		t.Error("robots fetch should not outlive request context")
+	}
+
+	// aborted fetch is not cached as no restriction
+	close(unblock)
+	if _, err := downloader.Download(req); err != ErrRobotsDisallowed {
+		t.Errorf("robots.txt should be fetched again, got %v", err)
+	}
+	if fetched.Get() != 2 {
+		t.Errorf("robots.txt should be fetched twice, got %d", fetched.Get())
+	}
+}
+
+func TestRobotsMiddlewareMissing(t *testing.T) {
+	server := httptest.NewServer(http.NotFoundHandler())
+	defer server.Close()
+
+	base, _ := NewDownloader(nil)
+	downloader := NewDownloaderChain(base, NewRobotsMiddleware(base, "gospider"))
+	req, _ := NewGetRequest(server.URL + "/private")
+	if _, err := downloader.Download(req); err != nil {
+		t.Errorf("missing robots.txt means no restriction, got %v", err)
+	}
+}
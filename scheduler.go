@@ -1,5 +1,7 @@
 package gospider
 
+import "sync"
+
 /**************************************************************
 * interface: Scheduler
 **************************************************************/
@@ -34,20 +36,32 @@ type Scheduler interface {
 // myScheduler is default implement of interface Scheduler
 type myScheduler struct {
 	Filter
-	Requests  chan *Request
+	Requests  RequestQueue
 	Responses chan *Response
 	Items     chan Item
 	Errors    chan error
+
+	// quit is closed when scheduler stop accepting data.
+	// data that can not be delivered after that will be stashed into pending
+	quit    chan struct{}
+	lock    sync.Mutex
+	pending []Data
+
+	// inflight counts data accepted but not yet fully handled
+	inflight Counter
+	stats    *myStats
 }
 
 // NewScheduler will create a new scheduler from given id
 func NewScheduler(reqBufSz, resBufSz, itemBufSz uint, filter Filter) Scheduler {
 	return &myScheduler{
 		Filter:    filter,
-		Requests:  make(chan *Request, reqBufSz),
+		Requests:  NewPriorityQueue(int(reqBufSz)),
 		Responses: make(chan *Response, resBufSz),
 		Items:     make(chan Item, itemBufSz),
-
+		quit:      make(chan struct{}),
+		inflight:  NewCounter(),
+		stats:     newStats(),
 	}
 }
 
@@ -56,27 +70,37 @@ func NewScheduler(reqBufSz, resBufSz, itemBufSz uint, filter Filter) Scheduler {
 // return value indicate whether this request is enqueued
 func (self *myScheduler) PutRequest(req *Request) bool {
 	if !req.IgnoreDupe && self.Filter != nil && self.Seen(req) {
-		self.Errors <- ErrDupeRequest
+		self.stats.deduped.Inc()
+		self.Errors <- NewCrawlError(StageSchedule, req, ErrDupeRequest)
 		return false
 	}
-	self.Requests <- req
+	self.stats.scheduled.Inc()
+	self.inflight.Inc()
+	if !self.Requests.Push(req) {
+		self.stash(req)
+	}
 	return true
 }
 
 // myScheduler_GetRequest will fetch a request from chan
 // block method
 func (self *myScheduler) GetRequest() *Request {
-	return <-self.Requests
+	return self.Requests.Pop()
 }
 
 func (self *myScheduler) LenRequests() int {
-	return len(self.Requests)
+	return self.Requests.Len()
 }
 
 // myScheduler_PutResponse will download Response from given request
 func (self *myScheduler) PutResponse(res *Response) {
 	if res != nil {
-		self.Responses <- res
+		self.inflight.Inc()
+		select {
+		case self.Responses <- res:
+		case <-self.quit:
+			self.stash(res)
+		}
 	}
 }
 
@@ -93,7 +117,13 @@ func (self *myScheduler) LenResponses() int {
 // myScheduler_PutItem will download Item from given request
 func (self *myScheduler) PutItem(item Item) {
 	if item != nil {
-		self.Items <- item
+		self.stats.items.Inc()
+		self.inflight.Inc()
+		select {
+		case self.Items <- item:
+		case <-self.quit:
+			self.stash(item)
+		}
 	}
 }
 
@@ -127,11 +157,90 @@ func (self *myScheduler) SendDataList(datum []Data) {
 }
 
 func (self *myScheduler) Pull(generator <-chan Data) {
-	go func() {
-		for datum := range generator {
+	go self.pull(generator)
+}
+
+// myScheduler_pull will send data from generator until it is closed
+// or scheduler quit. block method
+func (self *myScheduler) pull(generator <-chan Data) {
+	for {
+		select {
+		case datum, ok := <-generator:
+			if !ok {
+				return
+			}
 			self.SendData(datum)
+		case <-self.quit:
+			return
 		}
-	}()
+	}
+}
+
+// myScheduler_shutdown will stop accepting data and wake up blocking routines
+func (self *myScheduler) shutdown() {
+	close(self.quit)
+	self.Requests.Close()
+}
+
+// myScheduler_stash keeps data that can not be delivered after quit
+func (self *myScheduler) stash(datum Data) {
+	self.lock.Lock()
+	self.pending = append(self.pending, datum)
+	self.lock.Unlock()
+}
+
+// myScheduler_drain will take all stashed data and data remain in chan
+// requests returned have already passed dupe filter, so filter is disabled on them
+// caller must guarantee no one is sending to chan anymore
+func (self *myScheduler) drain() []Data {
+	self.lock.Lock()
+	data := self.pending
+	self.pending = nil
+	self.lock.Unlock()
+
+	for len(self.Responses) > 0 || len(self.Items) > 0 {
+		select {
+		case res := <-self.Responses:
+			data = append(data, res)
+		case item := <-self.Items:
+			data = append(data, item)
+		}
+	}
+	// checked before drain, since queue forgets leases then
+	data = self.unleased(data)
+	for _, req := range self.Requests.Drain() {
+		data = append(data, req)
+	}
+	for _, datum := range data {
+		if req, ok := datum.(*Request); ok {
+			req.DisableFilter()
+		}
+	}
+	return data
+}
+
+// myScheduler_unleased drop requests & responses of requests that queue takes back
+func (self *myScheduler) unleased(data []Data) []Data {
+	q, ok := self.Requests.(leaseQueue)
+	if !ok {
+		return data
+	}
+	kept := data[:0]
+	for _, datum := range data {
+		switch v := datum.(type) {
+		case *Request:
+			if q.leased(v) {
+				continue
+			}
+		case *Response:
+			if v.ack != nil && q.leased(v.ack) {
+				closeResponse(v)
+				continue
+			}
+		}
+		kept = append(kept, datum)
+	}
+	return kept
 }
 
 func (self *myScheduler) Idle() bool {
@@ -0,0 +1,133 @@
+package gospider
+
+import (
+	"fmt"
+	"io"
+	"time"
+)
+
+/**************************************************************
+* struct: Stats
+**************************************************************/
+
+// Stats is a snapshot of engine statistics, which could be exported
+type Stats struct {
+	Name       string        `json:"name"`
+	Elapsed    time.Duration `json:"elapsed"`
+	Scheduled  int64         `json:"scheduled"`
+	Deduped    int64         `json:"deduped"`
+	Downloaded int64         `json:"downloaded"`
+	Failed     int64         `json:"failed"`
+	Retried    int64         `json:"retried"`
+	Parsed     int64         `json:"parsed"`
+	Items      int64         `json:"items"`
+	Dropped    int64         `json:"dropped"`
+	Bytes      int64         `json:"bytes"`
+	Inflight   int64         `json:"inflight"`
+	Filter     *FilterStats  `json:"filter,omitempty"`
+}
+
+// Stats_String gives a human readable summary
+func (s Stats) String() string {
+	secs := s.Elapsed.Seconds()
+	if secs <= 0 {
+		secs = 1
+	}
+	return fmt.Sprintf("[%s] elapsed %s | "+
+		"req: %d scheduled, %d deduped | "+
+		"down: %d ok, %d fail, %d retry, %d bytes (%.2f page/s) | "+
+		"parse: %d | item: %d emitted, %d dropped (%.2f item/s) | inflight: %d",
+		s.Name, s.Elapsed.Truncate(time.Second),
+		s.Scheduled, s.Deduped,
+		s.Downloaded, s.Failed, s.Retried, s.Bytes, float64(s.Downloaded)/secs,
+		s.Parsed, s.Items, s.Dropped, float64(s.Items)/secs, s.Inflight) + s.filterString()
+}
+
+// Stats_filterString summarize filter stats if there is one
+func (s Stats) filterString() string {
+	if s.Filter == nil {
+		return ""
+	}
+	str := fmt.Sprintf(" | seen: %d unique", s.Filter.Len)
+	if s.Filter.Bytes > 0 {
+		str += fmt.Sprintf(", %d bytes", s.Filter.Bytes)
+	}
+	if s.Filter.FPRate > 0 {
+		str += fmt.Sprintf(", %.4f%% fp", s.Filter.FPRate*100)
+	}
+	return str
+}
+
+/**************************************************************
+* struct: myStats
+**************************************************************/
+
+// myStats holds live counters of each stage
+type myStats struct {
+	// start is unix nano time when counting starts, see restart
+	start      Counter
+	scheduled  Counter
+	deduped    Counter
+	downloaded Counter
+	failed     Counter
+	retried    Counter
+	parsed     Counter
+	items      Counter
+	dropped    Counter
+	bytes      Counter
+}
+
+// newStats create a zero stats start from now
+func newStats() *myStats {
+	stats := &myStats{
+		start:      NewCounter(),
+		scheduled:  NewCounter(),
+		deduped:    NewCounter(),
+		downloaded: NewCounter(),
+		failed:     NewCounter(),
+		retried:    NewCounter(),
+		parsed:     NewCounter(),
+		items:      NewCounter(),
+		dropped:    NewCounter(),
+		bytes:      NewCounter(),
+	}
+	stats.restart()
+	return stats
+}
+
+// myStats_restart reset elapsed time to start from now, counters are kept
+func (self *myStats) restart() {
+	self.start.Set(time.Now().UnixNano())
+}
+
+// myStats_Snapshot will copy current counter values into Stats
+func (self *myStats) Snapshot() Stats {
+	return Stats{
+		Elapsed:    time.Since(time.Unix(0, self.start.Get())),
+		Scheduled:  self.scheduled.Get(),
+		Deduped:    self.deduped.Get(),
+		Downloaded: self.downloaded.Get(),
+		Failed:     self.failed.Get(),
+		Retried:    self.retried.Get(),
+		Parsed:     self.parsed.Get(),
+		Items:      self.items.Get(),
+		Dropped:    self.dropped.Get(),
+		Bytes:      self.bytes.Get(),
+	}
+}
+
+/**************************************************************
+* type: countBody
+**************************************************************/
+
+// countBody wraps response body and add bytes read to counter
+type countBody struct {
+	io.ReadCloser
+	counter Counter
+}
+
+func (self *countBody) Read(b []byte) (n int, err error) {
+	n, err = self.ReadCloser.Read(b)
+	self.counter.Add(int64(n))
+	return
+}
@@ -0,0 +1,156 @@
+package gospider
+
+import (
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+/**************************************************************
+* struct: AutoThrottle
+**************************************************************/
+
+// AutoThrottle adjusts per host delay & concurrency from observed latency
+// delay converges to latency / TargetConcurrency, concurrency to requests
+// in flight at that delay, i.e. latency / delay. both back off sharply
+// on 429 Too Many Requests and 503 Service Unavailable
+type AutoThrottle struct {
+	// TargetConcurrency is average parallel requests expected on each host
+	TargetConcurrency float64
+
+	// StartDelay is initial delay of each host
+	StartDelay time.Duration
+
+	// MinDelay & MaxDelay bound adjusted delay
+	MinDelay time.Duration
+	MaxDelay time.Duration
+
+	// MaxConcurrency is upper bound of per host concurrency. zero means no bound
+	MaxConcurrency int
+}
+
+// NewAutoThrottle returns default presets
+func NewAutoThrottle() *AutoThrottle {
+	return &AutoThrottle{
+		TargetConcurrency: 1.0,
+		StartDelay:        5 * time.Second,
+		MinDelay:          0,
+		MaxDelay:          60 * time.Second,
+		MaxConcurrency:    8,
+	}
+}
+
+// AutoThrottle_clamp bound delay within [MinDelay, MaxDelay]
+func (self *AutoThrottle) clamp(delay time.Duration) time.Duration {
+	if delay < self.MinDelay {
+		delay = self.MinDelay
+	}
+	if self.MaxDelay > 0 && delay > self.MaxDelay {
+		delay = self.MaxDelay
+	}
+	return delay
+}
+
+// AutoThrottle_init set slot's initial delay & concurrency
+// concurrency of host policy, if any, bounds adjusted one as well
+func (self *AutoThrottle) init(s *hostSlot) {
+	s.Delay = self.clamp(maxDuration(s.Delay, self.StartDelay))
+	s.limit = self.MaxConcurrency
+	if s.Concurrency > 0 && (s.limit <= 0 || s.Concurrency < s.limit) {
+		s.limit = s.Concurrency
+	}
+	// ramp up from one request at a time
+	s.Concurrency = 1
+}
+
+// AutoThrottle_concurrency returns requests in flight expected at slot's delay
+// bounded by [1, limit] of slot
+func (self *AutoThrottle) concurrency(s *hostSlot, latency time.Duration) int {
+	n := int(math.Ceil(self.target()))
+	if s.Delay > 0 {
+		n = int((latency + s.Delay - 1) / s.Delay)
+	}
+	if s.limit > 0 && n > s.limit {
+		n = s.limit
+	}
+	if n < 1 {
+		n = 1
+	}
+	return n
+}
+
+// AutoThrottle_target returns TargetConcurrency, 1 if not set
+func (self *AutoThrottle) target() float64 {
+	if self.TargetConcurrency > 0 {
+		return self.TargetConcurrency
+	}
+	return 1.0
+}
+
+// AutoThrottle_adjust update slot according to a finished download
+// res may be nil when download failed, then nothing is changed
+func (self *AutoThrottle) adjust(s *hostSlot, latency time.Duration, res *Response, now time.Time) {
+	if res == nil || res.Response == nil {
+		return
+	}
+
+	code := res.StatusCode
+	if code == http.StatusTooManyRequests || code == http.StatusServiceUnavailable {
+		s.Delay = self.clamp(maxDuration(s.Delay*2, self.StartDelay))
+		if s.Concurrency > 1 {
+			s.Concurrency /= 2
+		}
+		if wait := RetryAfter(res, now); wait > 0 {
+			if next := now.Add(wait); next.After(s.next) {
+				s.next = next
+			}
+		}
+		return
+	}
+
+	delay := (s.Delay + time.Duration(float64(latency)/self.target())) / 2
+
+	// error response is usually fast, do not speed up because of that
+	if code >= 400 {
+		if delay > s.Delay {
+			s.Delay = self.clamp(delay)
+		}
+		return
+	}
+	s.Delay = self.clamp(delay)
+	s.Concurrency = self.concurrency(s, latency)
+}
+
+/**************************************************************
+* function: RetryAfter
+**************************************************************/
+
+// RetryAfter parse Retry-After header of response (seconds or http date)
+// return zero if header is absent or invalid
+func RetryAfter(res *Response, now time.Time) time.Duration {
+	if res == nil || res.Response == nil {
+		return 0
+	}
+	value := res.Header.Get("Retry-After")
+	if value == "" {
+		return 0
+	}
+	if secs, err := strconv.Atoi(value); err == nil {
+		if secs < 0 {
+			return 0
+		}
+		return time.Duration(secs) * time.Second
+	}
+	if t, err := http.ParseTime(value); err == nil && t.After(now) {
+		return t.Sub(now)
+	}
+	return 0
+}
+
+func maxDuration(a, b time.Duration) time.Duration {
+	if a > b {
+		return a
+	}
+	return b
+}
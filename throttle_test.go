@@ -0,0 +1,107 @@
+package gospider
+
+import (
+	"testing"
+	"time"
+)
+
+func TestAutoThrottle(t *testing.T) {
+	throttle := &AutoThrottle{
+		TargetConcurrency: 2,
+		StartDelay:        time.Second,
+		MaxDelay:          10 * time.Second,
+		MaxConcurrency:    4,
+	}
+	s := &hostSlot{}
+	throttle.init(s)
+	if s.Delay != time.Second || s.Concurrency != 1 {
+		t.Errorf("wrong initial slot: %+v", s.HostPolicy)
+	}
+
+	// latency 1s with target concurrency 2 converge delay to 500ms
+	now := time.Now()
+	ok := FakeResponse("http://a.com", "")
+	throttle.adjust(s, time.Second, ok, now)
+	if s.Delay != 750*time.Millisecond || s.Concurrency != 2 {
+		t.Errorf("delay should decrease toward target: %+v", s.HostPolicy)
+	}
+
+	// error response should not decrease delay
+	bad := FakeResponse("http://a.com", "")
+	bad.StatusCode = 500
+	throttle.adjust(s, 0, bad, now)
+	if s.Delay != 750*time.Millisecond {
+		t.Errorf("error response should not decrease delay: %+v", s.HostPolicy)
+	}
+
+	// 429 backs off and honor Retry-After
+	busy := FakeResponse("http://a.com", "")
+	busy.StatusCode = 429
+	busy.Header.Set("Retry-After", "30")
+	throttle.adjust(s, 0, busy, now)
+	if s.Delay != 1500*time.Millisecond || s.Concurrency != 1 {
+		t.Errorf("429 should back off: %+v", s.HostPolicy)
+	}
+	if s.next.Sub(now) != 30*time.Second {
+		t.Errorf("429 should honor Retry-After, got %s", s.next.Sub(now))
+	}
+}
+
+func TestAutoThrottleInit(t *testing.T) {
+	throttle := &AutoThrottle{StartDelay: time.Second, MaxConcurrency: 4}
+	cases := []struct {
+		policy, limit int
+	}{{0, 4}, {2, 2}, {8, 4}}
+	for _, c := range cases {
+		s := &hostSlot{HostPolicy: HostPolicy{Concurrency: c.policy}}
+		throttle.init(s)
+		if s.Concurrency != 1 || s.limit != c.limit {
+			t.Errorf("policy concurrency %d: should start from 1 bounded by %d, got %d & %d", c.policy, c.limit, s.Concurrency, s.limit)
+		}
+	}
+
+	// zero max concurrency means no bound
+	unbounded := &AutoThrottle{StartDelay: time.Second}
+	s := &hostSlot{}
+	unbounded.init(s)
+	if s.Concurrency != 1 || s.limit != 0 {
+		t.Errorf("zero max concurrency should not bound, got %d & %d", s.Concurrency, s.limit)
+	}
+}
+
+func TestAutoThrottleConverge(t *testing.T) {
+	now := time.Now()
+	ok := FakeResponse("http://a.com", "")
+	converge := func(throttle *AutoThrottle, latency time.Duration) *hostSlot {
+		s := &hostSlot{}
+		throttle.init(s)
+		for i := 0; i < 50; i++ {
+			throttle.adjust(s, latency, ok, now)
+		}
+		return s
+	}
+
+	// concurrency follows target rather than climbing to max
+	s := converge(&AutoThrottle{TargetConcurrency: 2, StartDelay: time.Second, MaxConcurrency: 8}, time.Second)
+	if d := s.Delay - 500*time.Millisecond; d < -time.Millisecond || d > time.Millisecond || s.Concurrency != 2 {
+		t.Errorf("should converge to target concurrency: %+v", s.HostPolicy)
+	}
+
+	// fast host is not sped up beyond min delay
+	s = converge(&AutoThrottle{TargetConcurrency: 4, StartDelay: time.Second, MinDelay: time.Second, MaxConcurrency: 8}, time.Second)
+	if s.Delay != time.Second || s.Concurrency != 1 {
+		t.Errorf("min delay should bound concurrency too: %+v", s.HostPolicy)
+	}
+
+	// zero max concurrency is unbounded
+	s = converge(&AutoThrottle{TargetConcurrency: 16, StartDelay: time.Second}, time.Second)
+	if s.Concurrency != 16 {
+		t.Errorf("concurrency should reach target without max, got %d", s.Concurrency)
+	}
+
+	// bounded by max concurrency
+	s = converge(&AutoThrottle{TargetConcurrency: 16, StartDelay: time.Second, MaxConcurrency: 3}, time.Second)
+	if s.Concurrency != 3 {
+		t.Errorf("concurrency should be bounded by max, got %d", s.Concurrency)
+	}
+}
@@ -0,0 +1,174 @@
+package gospider
+
+import (
+	"strconv"
+	"sync"
+	"time"
+	"github.com/go-redis/redis"
+)
+
+/**************************************************************
+* ttl: shared helpers
+**************************************************************/
+
+// ttlSweepInterval is max interval between two sweeps of in-memory ttl filter
+var ttlSweepInterval = time.Minute
+
+// requestTTL returns ttl of req, Meta[KeyTTL] overrides default one
+func requestTTL(req *Request, def time.Duration) time.Duration {
+	if ttl, ok := req.Meta.GetDuration(KeyTTL); ok {
+		return ttl
+	}
+	return def
+}
+
+/**************************************************************
+* struct: ttlFilter
+**************************************************************/
+
+// ttlEntry records last fetch time of a fingerprint and when it could be dropped
+type ttlEntry struct {
+	fetched time.Time
+	expire  time.Time
+}
+
+// ttlFilter treat request as seen only within ttl since last fetch
+type ttlFilter struct {
+	lock      sync.Mutex
+	ttl       time.Duration
+	seen      map[string]ttlEntry
+	lastSweep time.Time
+	now       func() time.Time
+	fp        *FingerprintOptions
+}
+
+// NewTTLFilter create in-memory filter that forgets requests ttl after last fetch
+// expired entries are swept lazily, per-request ttl could be set via Request.SetTTL
+func NewTTLFilter(ttl time.Duration, opts ...*FingerprintOptions) Filter {
+	return &ttlFilter{ttl: ttl, seen: make(map[string]ttlEntry), now: time.Now, fp: fingerprintOptions(opts)}
+}
+
+// ttlFilter_Seen : Caller must guarantee req is not nil
+func (self *ttlFilter) Seen(req *Request) bool {
+	return self.seenKey(self.fp.Fingerprint(req), requestTTL(req, self.ttl))
+}
+
+// ttlFilter_SeenURL test and set raw key with default ttl
+func (self *ttlFilter) SeenURL(url string) bool {
+	return self.seenKey(url, self.ttl)
+}
+
+// ttlFilter_Unsee implements ForgetFilter
+func (self *ttlFilter) Unsee(req *Request) bool {
+	key := self.fp.Fingerprint(req)
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	entry, ok := self.seen[key]
+	delete(self.seen, key)
+	return ok && self.now().Before(entry.expire)
+}
+
+// ttlFilter_seenKey test key against ttl and record fetch time if not seen
+// entry is kept for max(ttl, default ttl), longer override may see it swept earlier
+func (self *ttlFilter) seenKey(key string, ttl time.Duration) bool {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	now := self.now()
+	self.sweep(now)
+
+	if entry, ok := self.seen[key]; ok && now.Sub(entry.fetched) < ttl {
+		return true
+	}
+	keep := ttl
+	if keep < self.ttl {
+		keep = self.ttl
+	}
+	self.seen[key] = ttlEntry{fetched: now, expire: now.Add(keep)}
+	return false
+}
+
+// ttlFilter_sweep drop expired entries, at most once per sweep interval
+func (self *ttlFilter) sweep(now time.Time) {
+	interval := ttlSweepInterval
+	if self.ttl < interval {
+		interval = self.ttl
+	}
+	if now.Sub(self.lastSweep) < interval {
+		return
+	}
+	self.lastSweep = now
+	for key, entry := range self.seen {
+		if !now.Before(entry.expire) {
+			delete(self.seen, key)
+		}
+	}
+}
+
+/**************************************************************
+* struct: redisTTLFilter
+**************************************************************/
+
+// redisTTLScript returns 1 if key was fetched within ttl, otherwise record now
+// KEYS[1]: key  ARGV: now(ms) ttl(ms) keep(ms)
+var redisTTLScript = redis.NewScript(`
+local last = redis.call('GET', KEYS[1])
+if last and tonumber(ARGV[1]) - tonumber(last) < tonumber(ARGV[2]) then
+	return 1
+end
+redis.call('SET', KEYS[1], ARGV[1], 'PX', ARGV[3])
+return 0
+`)
+
+// redisTTLFilter stores last fetch time in redis string key `prefix:fingerprint`
+// with key TTL, so redis do expiry sweeping
+type redisTTLFilter struct {
+	prefix string
+	ttl    time.Duration
+	client *redis.Client
+	now    func() time.Time
+	fp     *FingerprintOptions
+}
+
+// NewRedisTTLFilter create redis filter that forgets requests ttl after last fetch
+// nodes sharing same prefix should have their clocks synchronized
+func NewRedisTTLFilter(redisURL string, prefix string, ttl time.Duration, opts ...*FingerprintOptions) (Filter, error) {
+	client, err := newRedisClient(redisURL)
+	if err != nil {
+		return nil, err
+	}
+	filter := &redisTTLFilter{prefix: prefix, ttl: ttl, client: client, now: time.Now, fp: fingerprintOptions(opts)}
+	return filter, nil
+}
+
+// redisTTLFilter_Seen : Caller must guarantee req is not nil
+func (self *redisTTLFilter) Seen(req *Request) bool {
+	return self.seenKey(self.fp.Fingerprint(req), requestTTL(req, self.ttl))
+}
+
+// redisTTLFilter_SeenURL test and set raw key with default ttl
+func (self *redisTTLFilter) SeenURL(url string) bool {
+	return self.seenKey(url, self.ttl)
+}
+
+// redisTTLFilter_Unsee implements ForgetFilter
+func (self *redisTTLFilter) Unsee(req *Request) bool {
+	n, _ := self.client.Del(self.prefix + ":" + self.fp.Fingerprint(req)).Result()
+	return n == 1
+}
+
+// redisTTLFilter_seenKey test and record key atomically
+func (self *redisTTLFilter) seenKey(key string, ttl time.Duration) bool {
+	keep := ttl
+	if keep < self.ttl {
+		keep = self.ttl
+	}
+	if keep < time.Millisecond {
+		keep = time.Millisecond
+	}
+	n, _ := redisTTLScript.Run(self.client, []string{self.prefix + ":" + key},
+		strconv.FormatInt(self.now().UnixNano()/int64(time.Millisecond), 10),
+		strconv.FormatInt(int64(ttl/time.Millisecond), 10),
+		strconv.FormatInt(int64(keep/time.Millisecond), 10),
+	).Int64()
+	return n == 1
+}
@@ -0,0 +1,93 @@
+package gospider
+
+import (
+	"testing"
+	"time"
+	"github.com/alicebob/miniredis/v2"
+)
+
+// testTTLFilter checks ttl semantics, advance moves filter clock forward
+func testTTLFilter(t *testing.T, filter Filter, advance func(time.Duration)) {
+	req, _ := NewGetRequest("http://a.com")
+	if filter.Seen(req) {
+		t.Error("you can not see what you haven't seen")
+	}
+	advance(time.Hour)
+	if !filter.Seen(req) {
+		t.Error("request should be seen within ttl")
+	}
+	advance(2 * time.Hour)
+	if filter.Seen(req) {
+		t.Error("request should be forgotten after ttl")
+	}
+
+	// per-request override
+	advance(time.Hour)
+	force, _ := NewGetRequest("http://a.com")
+	if filter.Seen(force.SetTTL(0)) {
+		t.Error("request with zero ttl should always pass")
+	}
+	longer, _ := NewGetRequest("http://a.com/longer")
+	filter.Seen(longer.SetTTL(4 * time.Hour))
+	advance(3 * time.Hour)
+	if !filter.Seen(longer) {
+		t.Error("request with longer ttl should be seen")
+	}
+
+	filter.Seen(req)
+	if ok, err := Forget(filter, req); !ok || err != nil {
+		t.Error("ttl filter should forget seen request")
+	}
+	if filter.Seen(req) {
+		t.Error("forgotten request should not be seen")
+	}
+}
+
+func TestTTLFilter(t *testing.T) {
+	now := time.Now()
+	filter := NewTTLFilter(2 * time.Hour).(*ttlFilter)
+	filter.now = func() time.Time { return now }
+	testTTLFilter(t, filter, func(d time.Duration) { now = now.Add(d) })
+
+	// expired entries are swept
+	for _, u := range []string{"http://b.com", "http://c.com"} {
+		filter.SeenURL(u)
+	}
+	now = now.Add(3 * time.Hour)
+	filter.SeenURL("http://d.com")
+	if len(filter.seen) != 1 {
+		t.Errorf("expired entries should be swept, %d left", len(filter.seen))
+	}
+}
+
+func TestRedisTTLFilter(t *testing.T) {
+	server, err := miniredis.Run()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+
+	filter, err := NewRedisTTLFilter("redis://"+server.Addr(), "test:ttl", 2*time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+	filter.(*redisTTLFilter).now = func() time.Time { return now }
+	testTTLFilter(t, filter, func(d time.Duration) {
+		now = now.Add(d)
+		server.FastForward(d)
+	})
+
+	filter.(*redisTTLFilter).SeenURL("http://b.com")
+	if ttl := server.TTL("test:ttl:http://b.com"); ttl != 2*time.Hour {
+		t.Errorf("key should expire with ttl, got %s", ttl)
+	}
+}
+
+func TestRequestSetTTL(t *testing.T) {
+	// request built without constructor has nil meta
+	req := &Request{}
+	if ttl, _ := req.SetTTL(time.Minute).Meta[KeyTTL].(time.Duration); ttl != time.Minute {
+		t.Errorf("ttl should be set on request without meta, got %v", ttl)
+	}
+}